@@ -1,11 +1,23 @@
 package datagram
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
 	"math"
 	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -218,3 +230,4098 @@ func TestHashedAndSequenced(t *testing.T) {
 	assert.Equal(t, 10, len(seqs))
 	assert.Equal(t, uint64(101), seqs[0])
 }
+
+func TestOnReject(t *testing.T) {
+	//
+	// Create a receiver that records rejections, and a sender using a
+	// different protocol hash.
+	//
+	var (
+		rejectedAddr   *net.UDPAddr
+		rejectedReason string
+	)
+	receiver, err := NewEndpoint(&Protocol{Hash: 42, Payload: 256}, 0, 8,
+		WithOnReject(func(addr *net.UDPAddr, reason string) {
+			rejectedAddr = addr
+			rejectedReason = reason
+		}),
+	)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&Protocol{Hash: 43, Payload: 256}, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Send the stranger datagram.
+	//
+	addr, _ := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(receiver.LocalAddress().Port))
+	w := sender.Writer()
+	w.WriteInt64(1)
+	err = sender.Send(w, addr, 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, from, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, reader)
+	assert.Nil(t, from)
+	if assert.NotNil(t, rejectedAddr) {
+		assert.Equal(t, sender.LocalAddress().Port, rejectedAddr.Port)
+	}
+	assert.Equal(t, RejectHash, rejectedReason)
+}
+
+func TestWarm(t *testing.T) {
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	send := func(to *Endpoint, n int) {
+		for i := 0; i < n; i++ {
+			assert.Nil(t, sender.Send(sender.Writer(), to.LocalAddress(), 20*time.Millisecond))
+		}
+	}
+	//
+	// Create an end point and drain its pools, as would happen with readers
+	// that are never closed, then warm them.
+	//
+	drained := func() *Endpoint {
+		e, err := NewEndpoint(&testprotocol, 0, 8)
+		assert.Nil(t, err)
+		for i := 0; i < 8; i++ {
+			e.buffers.Next()
+			e.writers.Next()
+		}
+		e.Warm()
+		return e
+	}
+	e := drained()
+	defer e.Close()
+	//
+	// AllocsPerRun makes one call before the runs, so four runs take five
+	// writers, each with a buffer, from the pools of eight without returning
+	// any.
+	//
+	var (
+		writers [5]*Writer
+		readers [5]*Reader
+		i, j    int
+	)
+	assert.Equal(t, float64(0), testing.AllocsPerRun(4, func() {
+		writers[i] = e.Writer()
+		i++
+	}))
+	//
+	// The first receives take their buffers from the pool. Receive always
+	// makes a new reader and address, so it should cost no more than once the
+	// pool is in use, while ReceiveReuse does not allocate at all.
+	//
+	receiver := drained()
+	defer receiver.Close()
+	send(receiver, 10)
+	first := testing.AllocsPerRun(4, func() {
+		readers[j], _, _, _ = receiver.Receive(time.Second)
+		j++
+	})
+	for _, reader := range readers {
+		if assert.NotNil(t, reader) {
+			reader.Close()
+		}
+	}
+	steady := testing.AllocsPerRun(4, func() {
+		reader, _, _, _ := receiver.Receive(time.Second)
+		reader.Close()
+	})
+	assert.Equal(t, steady, first)
+	reuse := drained()
+	defer reuse.Close()
+	send(reuse, 5)
+	assert.Equal(t, float64(0), testing.AllocsPerRun(4, func() {
+		reuse.ReceiveReuse(time.Second)
+	}))
+}
+
+func TestDatagramLen(t *testing.T) {
+	proto := &Protocol{
+		Hash:      42,
+		Sequenced: true,
+		Payload:   256,
+	}
+	receiver, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Send the headers plus an 8 byte integer and a 5 byte slice, which has
+	// a two byte length field.
+	//
+	w := sender.Writer()
+	w.WriteInt64(1)
+	w.Write([]byte("hello"))
+	err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	expected := 8 + 8 + 8 + 2 + 5
+	assert.Equal(t, expected, reader.DatagramLen())
+	_, err = reader.ReadInt64()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reader.DatagramLen())
+	_, err = reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reader.DatagramLen())
+}
+
+func TestHeaderOnlyDatagram(t *testing.T) {
+	proto := &Protocol{
+		Hash:      42,
+		Sequenced: true,
+		Payload:   256,
+	}
+	receiver, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Send a writer with nothing but the headers.
+	//
+	err = sender.Send(sender.Writer(), receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, addr, seq, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reader) {
+		assert.Equal(t, 0, reader.Remaining())
+		assert.Nil(t, reader.Close())
+	}
+	assert.NotNil(t, addr)
+	assert.Equal(t, uint64(1), seq)
+}
+
+func TestEmptyDatagram(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Send a writer with nothing at all.
+	//
+	err = sender.Send(sender.Writer(), receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, addr, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reader) {
+		assert.Equal(t, 0, reader.Remaining())
+		assert.Equal(t, 0, reader.DatagramLen())
+		assert.Nil(t, reader.Close())
+	}
+	assert.NotNil(t, addr)
+}
+
+func TestEmptyDatagramHashed(t *testing.T) {
+	receiver, err := NewEndpoint(&Protocol{Hash: 42, Payload: 256}, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// An empty datagram is too short to carry the hash so it is rejected
+	// rather than causing an error.
+	//
+	err = sender.Send(sender.Writer(), receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, reader)
+}
+
+func TestOversize(t *testing.T) {
+	//
+	// The default protocol payload is far smaller than the datagram, which is
+	// itself more than MaxPayload.
+	//
+	receiver, err := NewEndpoint(&testprotocol, 0, 8, WithAllowOversize(), WithPayload(MaxOversizePayload))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8, WithAllowOversize(), WithPayload(MaxOversizePayload))
+	assert.Nil(t, err)
+	defer sender.Close()
+	data := make([]byte, int(MaxPayload)+8)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	w := sender.Writer()
+	err = w.Write(data)
+	assert.Nil(t, err)
+	addr, _ := net.ResolveUDPAddr("udp", "[::1]:"+strconv.Itoa(receiver.LocalAddress().Port))
+	err = sender.Send(w, addr, 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reader) {
+		b, err := reader.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, data, b)
+		reader.Close()
+	}
+	//
+	// Without the option the payload is bounded.
+	//
+	assert.Panics(t, func() { NewEndpoint(&testprotocol, 0, 8, WithPayload(MaxOversizePayload)) })
+}
+
+func TestReceiveDedup(t *testing.T) {
+	proto := &Protocol{
+		Hash:      42,
+		Sequenced: true,
+		Payload:   256,
+	}
+	receiver, err := NewEndpoint(proto, 0, 8, WithPeerTracking())
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	addr, _ := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(receiver.LocalAddress().Port))
+	//
+	// Send sequence 4, then 5 twice.
+	//
+	for _, seq := range []uint64{3, 4, 4} {
+		sender.SetSequence(seq)
+		err = sender.Send(sender.Writer(), addr, 20*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	var (
+		seqs       []uint64
+		duplicates []bool
+	)
+	for i := 0; i < 3; i++ {
+		reader, _, seq, duplicate, err := receiver.ReceiveDedup(20 * time.Millisecond)
+		assert.Nil(t, err)
+		if assert.NotNil(t, reader) {
+			reader.Close()
+		}
+		seqs = append(seqs, seq)
+		duplicates = append(duplicates, duplicate)
+	}
+	assert.Equal(t, []uint64{4, 5, 5}, seqs)
+	assert.Equal(t, []bool{false, false, true}, duplicates)
+}
+
+func TestUserData(t *testing.T) {
+	e, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer e.Close()
+	assert.Nil(t, e.UserData())
+	type session struct {
+		id string
+	}
+	e.SetUserData(&session{id: "abc"})
+	s, ok := e.UserData().(*session)
+	if assert.True(t, ok) {
+		assert.Equal(t, "abc", s.id)
+	}
+}
+
+func TestDatagrams(t *testing.T) {
+	proto := &Protocol{
+		Hash:      42,
+		Sequenced: true,
+		Payload:   256,
+	}
+	receiver, err := NewEndpoint(proto, 0, 16)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(proto, 0, 16)
+	assert.Nil(t, err)
+	defer sender.Close()
+	addr, _ := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(receiver.LocalAddress().Port))
+	//
+	// Consume from the channel.
+	//
+	ctx, cxl := context.WithCancel(context.Background())
+	ch := receiver.Datagrams(ctx)
+	for i := 0; i < 10; i++ {
+		w := sender.Writer()
+		w.WriteInt64(int64(i))
+		err = sender.Send(w, addr, 20*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case d := <-ch:
+			v, err := d.Reader.ReadInt64()
+			assert.Nil(t, err)
+			assert.Equal(t, int64(i), v)
+			assert.Equal(t, uint64(i+1), d.Seq)
+			assert.Equal(t, sender.LocalAddress().Port, d.Addr.Port)
+			d.Reader.Close()
+		case <-time.After(time.Second):
+			t.Fatal("timed out")
+		}
+	}
+	//
+	// Cancelling closes the channel.
+	//
+	cxl()
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("not closed")
+	}
+	//
+	// A later Receive without a timeout still waits for a datagram.
+	//
+	results := receiver.ReceiveChan(0)
+	select {
+	case r := <-results:
+		t.Fatal("did not wait", r.Err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Nil(t, sender.Send(sender.Writer(), addr, 20*time.Millisecond))
+	select {
+	case r := <-results:
+		assert.Nil(t, r.Err)
+		assert.NotNil(t, r.Reader)
+		r.Reader.Close()
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestDatagramsBackoff(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 16)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	receiver.SetMaxReceiveBody(8)
+	sender, err := NewEndpoint(&testprotocol, 0, 16)
+	assert.Nil(t, err)
+	defer sender.Close()
+	ctx, cxl := context.WithCancel(context.Background())
+	defer cxl()
+	ch := receiver.Datagrams(ctx)
+	//
+	// The waits after six errors in a row add up to 31 ms, after which a good
+	// payload is still delivered.
+	//
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		assert.Nil(t, sender.SendBytes(make([]byte, 16), receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	assert.Nil(t, sender.SendBytes(make([]byte, 8), receiver.LocalAddress(), 20*time.Millisecond))
+	select {
+	case d := <-ch:
+		assert.GreaterOrEqual(t, time.Since(start), 31*time.Millisecond)
+		assert.Equal(t, 8, d.Reader.Remaining())
+		d.Reader.Close()
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8, WithRateLimit(100, 1))
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Sending 11 datagrams at 100 per second takes at least 100ms.
+	//
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		err = sender.Send(sender.Writer(), receiver.LocalAddress(), 0)
+		assert.Nil(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	//
+	// Without waiting, the second of two immediate sends fails.
+	//
+	hasty, err := NewEndpoint(&testprotocol, 0, 8, WithRateLimit(1, 1), WithRateLimitNoWait())
+	assert.Nil(t, err)
+	defer hasty.Close()
+	err = hasty.Send(hasty.Writer(), receiver.LocalAddress(), 0)
+	assert.Nil(t, err)
+	err = hasty.Send(hasty.Writer(), receiver.LocalAddress(), 0)
+	assert.ErrorIs(t, err, ErrRateLimited)
+}
+
+func TestDeadLetter(t *testing.T) {
+	var (
+		payload []byte
+		to      *net.UDPAddr
+		failure error
+	)
+	sender, err := NewEndpoint(&testprotocol, 0, 8,
+		WithDeadLetter(func(b []byte, addr *net.UDPAddr, err error) {
+			payload = b
+			to = addr
+			failure = err
+		}),
+	)
+	assert.Nil(t, err)
+	addr, _ := net.ResolveUDPAddr("udp", "localhost:9")
+	//
+	// Sending from a closed end point fails.
+	//
+	w := sender.Writer()
+	w.Write([]byte("lost"))
+	sender.Close()
+	err = sender.Send(w, addr, 0)
+	assert.True(t, IsClosed(err))
+	assert.Equal(t, []byte{0, 4, 'l', 'o', 's', 't'}, payload)
+	assert.Equal(t, addr, to)
+	assert.Equal(t, err, failure)
+}
+
+func TestVarBytes(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	for _, length := range []int{0, 1, 127, 128, 200} {
+		data := make([]byte, length)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		w := sender.Writer()
+		err = w.WriteVarBytes(data)
+		assert.Nil(t, err)
+		prefix := 1
+		if length >= 128 {
+			prefix = 2
+		}
+		assert.Equal(t, 256-prefix-length, w.Remaining())
+		err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+		assert.Nil(t, err)
+		reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		b, err := reader.ReadVarBytes()
+		assert.Nil(t, err)
+		assert.Equal(t, data, b)
+		reader.Close()
+	}
+}
+
+func TestReaderClone(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	w.WriteInt64(1)
+	w.WriteInt64(2)
+	w.WriteInt64(3)
+	err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	//
+	// Fork after the first field, then read different amounts.
+	//
+	v, _ := reader.ReadInt64()
+	assert.Equal(t, int64(1), v)
+	clone := reader.Clone()
+	v, _ = clone.ReadInt64()
+	assert.Equal(t, int64(2), v)
+	v, _ = clone.ReadInt64()
+	assert.Equal(t, int64(3), v)
+	assert.Equal(t, 0, clone.Remaining())
+	assert.Equal(t, 16, reader.Remaining())
+	v, _ = reader.ReadInt64()
+	assert.Equal(t, int64(2), v)
+	//
+	// Closing the clone leaves the original usable.
+	//
+	assert.Nil(t, clone.Close())
+	v, err = reader.ReadInt64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), v)
+	assert.Nil(t, reader.Close())
+}
+
+// reversedCodec writes the sequence before the hash.
+type reversedCodec struct {
+	hash uint64
+}
+
+func (c *reversedCodec) Write(w *Writer, e *Endpoint) error {
+	if err := w.WriteUint64(e.NextSequence()); err != nil {
+		return err
+	}
+	return w.WriteUint64(c.hash)
+}
+
+func (c *reversedCodec) Read(r *Reader, e *Endpoint) (ok bool, seq uint64, err error) {
+	if seq, err = r.ReadUint64(); err != nil {
+		return
+	}
+	var hash uint64
+	if hash, err = r.ReadUint64(); err != nil {
+		return
+	}
+	ok = hash == c.hash
+	return
+}
+
+func (c *reversedCodec) Size() int {
+	return 16
+}
+
+func TestHeaderCodec(t *testing.T) {
+	proto := &Protocol{
+		Sequenced: true,
+		Payload:   256,
+		Codec:     &reversedCodec{hash: 42},
+	}
+	receiver, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	sender.SetSequence(6)
+	w := sender.Writer()
+	w.WriteInt64(99)
+	assert.Equal(t, 256-24, w.Remaining())
+	err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, seq, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), seq)
+	if assert.NotNil(t, reader) {
+		v, err := reader.ReadInt64()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(99), v)
+		reader.Close()
+	}
+	//
+	// A stranger using the built in header is rejected.
+	//
+	stranger, err := NewEndpoint(&Protocol{Hash: 42, Sequenced: true, Payload: 256}, 0, 8)
+	assert.Nil(t, err)
+	defer stranger.Close()
+	err = stranger.Send(stranger.Writer(), receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err = receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, reader)
+}
+
+// failingCodec cannot write its header.
+type failingCodec struct {
+	reversedCodec
+}
+
+var errHeader = errors.New("header")
+
+func (c *failingCodec) Write(w *Writer, e *Endpoint) error {
+	return errHeader
+}
+
+func TestHeaderCodecError(t *testing.T) {
+	sender, err := NewEndpoint(&Protocol{Payload: 256, Codec: &failingCodec{}}, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	assert.ErrorIs(t, w.WriteUint64(1), errHeader)
+	assert.ErrorIs(t, sender.Send(w, sender.LocalAddress(), 20*time.Millisecond), errHeader)
+	assert.ErrorIs(t, sender.SendQueuedPriority(sender.Writer(), sender.LocalAddress(), 0), errHeader)
+	assert.Equal(t, 0, sender.OutstandingBuffers())
+}
+
+func TestLocalPort(t *testing.T) {
+	e, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer e.Close()
+	assert.NotZero(t, e.LocalPort())
+	assert.Equal(t, e.LocalAddress().Port, e.LocalPort())
+}
+
+func TestVarString(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	long := strings.Repeat("abcdefghij", 20)
+	w := sender.Writer()
+	assert.Nil(t, w.WriteVarString(""))
+	assert.Nil(t, w.WriteVarString("hello"))
+	assert.Nil(t, w.WriteVarString(long))
+	assert.Equal(t, 256-(1)-(1+5)-(2+200), w.Remaining())
+	err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	for _, expected := range []string{"", "hello", long} {
+		s, err := reader.ReadVarString()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, s)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	proto := &Protocol{
+		Hash:      42,
+		Sequenced: true,
+		Payload:   256,
+	}
+	responder, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer responder.Close()
+	requester, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer requester.Close()
+	//
+	// Echo one payload back to its source, after a late reply to an earlier
+	// request that must be discarded.
+	//
+	go func() {
+		reader, addr, seq, err := responder.Receive(time.Second)
+		if err != nil || reader == nil {
+			return
+		}
+		b, _ := reader.Read()
+		reader.Close()
+		w := responder.ReplyWriter(seq - 1)
+		w.Write([]byte("late"))
+		responder.Send(w, addr, time.Second)
+		w = responder.ReplyWriter(seq)
+		w.Write(b)
+		responder.Send(w, addr, time.Second)
+	}()
+	addr, _ := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(responder.LocalPort()))
+	w := requester.Writer()
+	w.Write([]byte("ping"))
+	reader, from, err := requester.Request(w, addr, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, responder.LocalPort(), from.Port)
+	if assert.NotNil(t, reader) {
+		b, err := reader.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, "ping", string(b))
+		assert.Nil(t, reader.AssertEmpty())
+		reader.Close()
+	}
+	//
+	// Without a responder the request times out.
+	//
+	w = requester.Writer()
+	_, _, err = requester.Request(w, addr, 20*time.Millisecond)
+	assert.True(t, IsTimeout(err))
+	var opErr *OpError
+	assert.ErrorAs(t, err, &opErr)
+	//
+	// The same error is returned when a payload from another address uses up
+	// the timeout.
+	//
+	slow, err := NewEndpoint(proto, 0, 8, WithReceiveFilter(func([]byte, *net.UDPAddr) bool {
+		time.Sleep(20 * time.Millisecond)
+		return true
+	}))
+	assert.Nil(t, err)
+	defer slow.Close()
+	stranger, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer stranger.Close()
+	assert.Nil(t, stranger.Send(stranger.Writer(), slow.LocalAddress(), 20*time.Millisecond))
+	w = slow.Writer()
+	_, _, err = slow.Request(w, addr, 10*time.Millisecond)
+	assert.True(t, IsTimeout(err))
+	assert.ErrorAs(t, err, &opErr)
+	assert.Equal(t, OpReceive, opErr.Op)
+}
+
+func TestReceiveMigrated(t *testing.T) {
+	proto := &Protocol{
+		Hash:      42,
+		Sequenced: true,
+		Payload:   256,
+	}
+	receiver, err := NewEndpoint(proto, 0, 8, WithMigration())
+	assert.Nil(t, err)
+	defer receiver.Close()
+	addr, _ := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(receiver.LocalPort()))
+	//
+	// The stream starts from one address and continues from another.
+	//
+	before, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer before.Close()
+	after, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer after.Close()
+	for i := 0; i < 3; i++ {
+		err = before.Send(before.Writer(), addr, 20*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	after.SetSequence(before.LastSequence())
+	for i := 0; i < 2; i++ {
+		err = after.Send(after.Writer(), addr, 20*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	var migrations []bool
+	for i := 0; i < 5; i++ {
+		reader, _, _, migrated, err := receiver.ReceiveMigrated(20 * time.Millisecond)
+		assert.Nil(t, err)
+		if assert.NotNil(t, reader) {
+			reader.Close()
+		}
+		migrations = append(migrations, migrated)
+	}
+	assert.Equal(t, []bool{false, false, false, true, false}, migrations)
+	//
+	// A new sender whose first datagram was lost does not take over a peer
+	// that has only sent one datagram.
+	//
+	first, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer first.Close()
+	second, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer second.Close()
+	assert.Nil(t, first.Send(first.Writer(), addr, 20*time.Millisecond))
+	second.SetSequence(1)
+	assert.Nil(t, second.Send(second.Writer(), addr, 20*time.Millisecond))
+	migrations = nil
+	for i := 0; i < 2; i++ {
+		reader, _, _, migrated, err := receiver.ReceiveMigrated(20 * time.Millisecond)
+		assert.Nil(t, err)
+		if assert.NotNil(t, reader) {
+			reader.Close()
+		}
+		migrations = append(migrations, migrated)
+	}
+	assert.Equal(t, []bool{false, false}, migrations)
+}
+
+func TestMigrationIndex(t *testing.T) {
+	proto := &Protocol{
+		Hash:      42,
+		Sequenced: true,
+		Payload:   256,
+	}
+	receiver, err := NewEndpoint(proto, 0, 8, WithMigration(), WithAddressLimit(3))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	addr, _ := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(receiver.LocalPort()))
+	sender := func() *Endpoint {
+		e, err := NewEndpoint(proto, 0, 8)
+		assert.Nil(t, err)
+		t.Cleanup(func() { e.Close() })
+		return e
+	}
+	send := func(e *Endpoint, n int) (migrations []bool) {
+		for i := 0; i < n; i++ {
+			assert.Nil(t, e.Send(e.Writer(), addr, 20*time.Millisecond))
+			reader, _, _, migrated, err := receiver.ReceiveMigrated(time.Second)
+			assert.Nil(t, err)
+			if assert.NotNil(t, reader) {
+				reader.Close()
+			}
+			migrations = append(migrations, migrated)
+		}
+		return
+	}
+	//
+	// Two established peers expecting the same sequence number are ambiguous.
+	//
+	a, b := sender(), sender()
+	send(a, 3)
+	send(b, 3)
+	assert.Len(t, receiver.expected, 1)
+	c := sender()
+	c.SetSequence(3)
+	assert.Equal(t, []bool{false}, send(c, 1))
+	//
+	// Each established peer is indexed once, however much it sends.
+	//
+	send(a, 5)
+	assert.Len(t, receiver.expected, 1)
+	assert.Equal(t, uint16(a.LocalPort()), receiver.expected[9].Port())
+	d := sender()
+	d.SetSequence(8)
+	assert.Equal(t, []bool{true}, send(d, 1))
+	//
+	// The peers are bounded by the address limit.
+	//
+	send(sender(), 1)
+	assert.Len(t, receiver.peers, 3)
+}
+
+func TestFloat64Delta(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	series := []float64{100, 100.5, 101.25, 99.75, 99.75}
+	w := sender.Writer()
+	var prev float64
+	for _, v := range series {
+		assert.Nil(t, w.WriteFloat64Delta(v, prev))
+		prev = v
+	}
+	err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	prev = 0
+	for _, expected := range series {
+		v, err := reader.ReadFloat64Delta(prev)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, v)
+		prev = v
+	}
+}
+
+func TestFits(t *testing.T) {
+	for _, tc := range []struct {
+		protocol Protocol
+		header   int
+	}{
+		{Protocol{Payload: 256}, 0},
+		{Protocol{Hash: 42, Payload: 256}, 8},
+		{Protocol{Hash: 42, Sequenced: true, Payload: 256}, 16},
+		{Protocol{Sequenced: true, Payload: 256, Codec: &reversedCodec{}}, 16},
+	} {
+		assert.True(t, tc.protocol.Fits(256-tc.header))
+		assert.True(t, tc.protocol.Fits(255-tc.header))
+		assert.False(t, tc.protocol.Fits(257-tc.header))
+	}
+}
+
+func TestWriterTruncate(t *testing.T) {
+	proto := &Protocol{
+		Hash:      42,
+		Sequenced: true,
+		Payload:   64,
+	}
+	receiver, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Write, save, then roll back a write that would not all fit.
+	//
+	w := sender.Writer()
+	assert.Nil(t, w.WriteInt64(1))
+	saved := w.Len()
+	assert.Nil(t, w.Write([]byte("0123456789")))
+	assert.Equal(t, ErrOverflow, w.Write(make([]byte, 30)))
+	assert.Nil(t, w.Truncate(saved))
+	assert.Equal(t, saved, w.Len())
+	assert.Equal(t, ErrInvalidLength, w.Truncate(saved+1))
+	assert.Equal(t, ErrInvalidLength, w.Truncate(8))
+	assert.Nil(t, w.WriteInt64(2))
+	err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, seq, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), seq)
+	defer reader.Close()
+	v, _ := reader.ReadInt64()
+	assert.Equal(t, int64(1), v)
+	v, _ = reader.ReadInt64()
+	assert.Equal(t, int64(2), v)
+	assert.Equal(t, 0, reader.Remaining())
+}
+
+func TestHashString(t *testing.T) {
+	receiver, err := NewEndpoint(&Protocol{HashString: "my-protocol/v1", Payload: 256}, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&Protocol{HashString: "my-protocol/v1", Payload: 256}, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	stranger, err := NewEndpoint(&Protocol{HashString: "my-protocol/v2", Payload: 256}, 0, 8)
+	assert.Nil(t, err)
+	defer stranger.Close()
+	assert.NotZero(t, receiver.hash)
+	assert.Equal(t, receiver.hash, sender.hash)
+	assert.NotEqual(t, receiver.hash, stranger.hash)
+	for _, e := range []*Endpoint{sender, stranger} {
+		w := e.Writer()
+		w.WriteInt64(1)
+		err = e.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reader) {
+		v, _ := reader.ReadInt64()
+		assert.Equal(t, int64(1), v)
+		reader.Close()
+	}
+	reader, _, _, err = receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, reader)
+	//
+	// A protocol cannot have both.
+	//
+	assert.Panics(t, func() { NewEndpoint(&Protocol{Hash: 42, HashString: "x", Payload: 256}, 0, 8) })
+}
+
+func TestZigzag(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	values := []int64{-1, 0, 1, -64, 63, -65, math.MaxInt64, math.MinInt64}
+	sizes := []int{1, 1, 1, 1, 1, 2, 10, 10}
+	w := sender.Writer()
+	for i, v := range values {
+		before := w.Len()
+		assert.Nil(t, w.WriteZigzag(v))
+		assert.Equal(t, sizes[i], w.Len()-before, v)
+	}
+	err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	for _, expected := range values {
+		v, err := reader.ReadZigzag()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, v)
+	}
+	_, err = reader.ReadZigzag()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	//
+	// A varint cut short is also truncated.
+	//
+	assert.Nil(t, sender.SendBytes([]byte{0x80}, receiver.LocalAddress(), 20*time.Millisecond))
+	truncated, _, _, err := receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	if assert.NotNil(t, truncated) {
+		_, err = truncated.ReadZigzag()
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		truncated.Close()
+	}
+}
+
+func TestSendBytes(t *testing.T) {
+	//
+	// Capture exactly what is on the wire.
+	//
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	wire := func() []byte {
+		b := make([]byte, 256)
+		n, _, err := conn.ReadFromUDP(b)
+		assert.Nil(t, err)
+		return b[:n]
+	}
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	for _, proto := range []*Protocol{
+		&testprotocol,
+		{Hash: 42, Sequenced: true, Payload: 256},
+	} {
+		sender, err := NewEndpoint(proto, 0, 8)
+		assert.Nil(t, err)
+		w := sender.Writer()
+		w.WriteInt64(7)
+		w.Write([]byte("cached"))
+		body := append([]byte(nil), w.buffer.Bytes()[proto.headerSize():]...)
+		err = sender.Send(w, addr, 20*time.Millisecond)
+		assert.Nil(t, err)
+		expected := wire()
+		sender.SetSequence(sender.LastSequence() - 1)
+		err = sender.SendBytes(body, addr, 20*time.Millisecond)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, wire())
+		sender.Close()
+	}
+}
+
+func TestRebind(t *testing.T) {
+	e, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	port := e.LocalPort()
+	e.Close()
+	for i := 0; i < 50; i++ {
+		e, err = NewEndpoint(&testprotocol, port, 8)
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Equal(t, port, e.LocalPort())
+		assert.Nil(t, e.Close())
+	}
+}
+
+func TestReadAllString(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	err = receiver.SendBytes([]byte{0, 0, 0, 0, 0, 0, 0, 1, 'h', 'e', 'l', 'l', 'o'}, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	v, err := reader.ReadInt64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), v)
+	s, err := reader.ReadAllString()
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", s)
+	assert.Equal(t, 0, reader.Remaining())
+	reader.Close()
+	_, err = reader.ReadAllString()
+	assert.Equal(t, ErrClosedReader, err)
+	assert.Equal(t, "hello", s)
+}
+
+func TestConn(t *testing.T) {
+	e, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer e.Close()
+	conn := e.Conn()
+	assert.Equal(t, e.LocalAddress(), conn.LocalAddr())
+	assert.Nil(t, conn.SetReadBuffer(1<<20))
+}
+
+func TestPadTo(t *testing.T) {
+	proto := &Protocol{
+		Hash:      42,
+		Sequenced: true,
+		Payload:   256,
+		PadTo:     128,
+	}
+	receiver, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Every datagram has the same length whatever the body.
+	//
+	bodies := []string{"", "a", "hello world", strings.Repeat("x", 128-18-2)}
+	for _, body := range bodies {
+		w := sender.Writer()
+		assert.Nil(t, w.Write([]byte(body)))
+		err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	for _, body := range bodies {
+		reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		if !assert.NotNil(t, reader) {
+			continue
+		}
+		assert.Equal(t, 128, reader.DatagramLen())
+		b, err := reader.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, body, string(b))
+		assert.Equal(t, 0, reader.Remaining())
+		reader.Close()
+	}
+	//
+	// The body cannot be larger than the padded size allows.
+	//
+	w := sender.Writer()
+	assert.Equal(t, 110, w.Remaining())
+	assert.Equal(t, ErrOverflow, w.Write(make([]byte, 110)))
+}
+
+func TestReceiveDispatch(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	var (
+		v1 int64
+		v2 string
+	)
+	receiver.RegisterVersionHandler(1, func(r *Reader) (err error) {
+		v1, err = r.ReadInt64()
+		return
+	})
+	receiver.RegisterVersionHandler(2, func(r *Reader) (err error) {
+		v2, err = r.ReadVarString()
+		return
+	})
+	//
+	// Send one of each version, then an unknown version.
+	//
+	w := sender.Writer()
+	w.WriteUint8(1)
+	w.WriteInt64(11)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	w = sender.Writer()
+	w.WriteUint8(2)
+	w.WriteVarString("two")
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	w = sender.Writer()
+	w.WriteUint8(3)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	_, _, err = receiver.ReceiveDispatch(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), v1)
+	assert.Equal(t, "", v2)
+	_, _, err = receiver.ReceiveDispatch(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, "two", v2)
+	_, _, err = receiver.ReceiveDispatch(20 * time.Millisecond)
+	assert.Equal(t, ErrUnsupportedVersion, err)
+}
+
+func TestBitSet(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	sets := []struct {
+		bits uint64
+		n    int
+		size int
+	}{
+		{0b101, 3, 1},
+		{0b10000001, 8, 1},
+		{0x8000_0000_0000_0001, 64, 8},
+	}
+	w := sender.Writer()
+	for _, s := range sets {
+		before := w.Len()
+		assert.Nil(t, w.WriteBitSet(s.bits, s.n))
+		assert.Equal(t, s.size, w.Len()-before)
+	}
+	assert.Equal(t, ErrInvalidLength, w.WriteBitSet(0, 65))
+	err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	for _, s := range sets {
+		bits, err := reader.ReadBitSet(s.n)
+		assert.Nil(t, err)
+		assert.Equal(t, s.bits, bits)
+	}
+}
+
+func TestReceiveChan(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Nothing has been sent so the timer wins.
+	//
+	ch := receiver.ReceiveChan(50 * time.Millisecond)
+	select {
+	case <-ch:
+		t.Error("unexpected result")
+	case <-time.After(10 * time.Millisecond):
+	}
+	r := <-ch
+	assert.True(t, IsTimeout(r.Err))
+	//
+	// Now the datagram wins.
+	//
+	w := sender.Writer()
+	w.WriteInt64(5)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	select {
+	case r := <-receiver.ReceiveChan(time.Second):
+		assert.Nil(t, r.Err)
+		assert.Equal(t, sender.LocalPort(), r.Addr.Port)
+		v, _ := r.Reader.ReadInt64()
+		assert.Equal(t, int64(5), v)
+		r.Reader.Close()
+	case <-time.After(time.Second):
+		t.Error("timed out")
+	}
+}
+
+func TestSourceRateLimit(t *testing.T) {
+	rejected := 0
+	receiver, err := NewEndpoint(&testprotocol, 0, 128,
+		WithSourceRateLimit(10),
+		WithOnReject(func(addr *net.UDPAddr, reason string) {
+			if reason == RejectRate {
+				rejected++
+			}
+		}),
+	)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	flood, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer flood.Close()
+	normal, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer normal.Close()
+	addr, _ := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(receiver.LocalPort()))
+	for i := 0; i < 50; i++ {
+		flood.Send(flood.Writer(), addr, 20*time.Millisecond)
+		if i%10 == 0 {
+			normal.Send(normal.Writer(), addr, 20*time.Millisecond)
+		}
+	}
+	received := make(map[int]int)
+	for {
+		reader, from, _, err := receiver.Receive(50 * time.Millisecond)
+		if IsTimeout(err) {
+			break
+		}
+		assert.Nil(t, err)
+		if reader != nil {
+			received[from.Port]++
+			reader.Close()
+		}
+	}
+	assert.Equal(t, 5, received[normal.LocalPort()])
+	assert.LessOrEqual(t, received[flood.LocalPort()], 12)
+	assert.Equal(t, 50, received[flood.LocalPort()]+rejected)
+	//
+	// Limiters are only kept for the most recent sources.
+	//
+	bounded, err := NewEndpoint(&testprotocol, 0, 8, WithSourceRateLimit(10), WithAddressLimit(2))
+	assert.Nil(t, err)
+	defer bounded.Close()
+	for i := 0; i < 3; i++ {
+		source, err := NewEndpoint(&testprotocol, 0, 8)
+		assert.Nil(t, err)
+		defer source.Close()
+		assert.Nil(t, source.Send(source.Writer(), bounded.LocalAddress(), 20*time.Millisecond))
+		reader, _, _, err := bounded.Receive(time.Second)
+		assert.Nil(t, err)
+		if assert.NotNil(t, reader) {
+			reader.Close()
+		}
+		assert.LessOrEqual(t, len(bounded.sources), 2)
+	}
+	assert.Len(t, bounded.sources, 2)
+}
+
+func TestTLV(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	records := []struct {
+		tag   uint16
+		value []byte
+	}{
+		{1, []byte("name")},
+		{7, []byte{}},
+		{0xffff, []byte{1, 2, 3}},
+	}
+	w := sender.Writer()
+	for _, rec := range records {
+		assert.Nil(t, w.WriteTLV(rec.tag, rec.value))
+	}
+	err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	//
+	// Consume records until the payload is exhausted.
+	//
+	i := 0
+	for reader.Remaining() > 0 {
+		tag, value, err := reader.ReadTLV()
+		if !assert.Nil(t, err) {
+			break
+		}
+		assert.Equal(t, records[i].tag, tag)
+		assert.Equal(t, records[i].value, value)
+		i++
+	}
+	assert.Equal(t, len(records), i)
+}
+
+func benchmarkRead(b *testing.B, options ...func(*Endpoint)) {
+	e, _ := NewEndpoint(&testprotocol, 0, 8, options...)
+	defer e.Close()
+	frame := append([]byte{0, 64}, make([]byte, 64)...)
+	reader := &Reader{
+		buffer:   new(bytes.Buffer),
+		endpoint: e,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader.buffer.Reset()
+		reader.buffer.Write(frame)
+		v, _ := reader.Read()
+		e.Release(v)
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkRead(b)
+}
+
+func BenchmarkReadPooled(b *testing.B) {
+	benchmarkRead(b, WithPooledRead())
+}
+
+func TestPooledRead(t *testing.T) {
+	e, err := NewEndpoint(&testprotocol, 0, 8, WithPooledRead())
+	assert.Nil(t, err)
+	defer e.Close()
+	err = e.SendBytes([]byte{0, 3, 'a', 'b', 'c'}, e.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := e.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	v, err := reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", string(v))
+	assert.Equal(t, 256, cap(v))
+	e.Release(v)
+}
+
+func TestHeaderSize(t *testing.T) {
+	for _, tc := range []struct {
+		protocol Protocol
+		size     int
+	}{
+		{Protocol{Payload: 256}, 0},
+		{Protocol{Hash: 42, Payload: 256}, 8},
+		{Protocol{HashString: "x", Payload: 256}, 8},
+		{Protocol{Sequenced: true, Payload: 256}, 8},
+		{Protocol{Hash: 42, Sequenced: true, Payload: 256}, 16},
+		{Protocol{Hash: 42, Sequenced: true, Payload: 256, PadTo: 128}, 18},
+		{Protocol{Payload: 256, Codec: &reversedCodec{}}, 16},
+	} {
+		e, err := NewEndpoint(&tc.protocol, 0, 8)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.size, e.HeaderSize())
+		w := e.Writer()
+		assert.Equal(t, tc.size, w.Len())
+		e.Close()
+	}
+}
+
+func TestWriteWriter(t *testing.T) {
+	proto := &Protocol{
+		Hash:      42,
+		Sequenced: true,
+		Payload:   256,
+	}
+	receiver, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Assemble a message from two fragments.
+	//
+	first := sender.Writer()
+	first.WriteInt64(1)
+	second := sender.Writer()
+	second.Write([]byte("two"))
+	w := sender.Writer()
+	assert.Nil(t, w.WriteWriter(first))
+	assert.Nil(t, w.WriteWriter(second))
+	assert.Equal(t, 16+8+5, w.Len())
+	err = sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Nil(t, err)
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	v, _ := reader.ReadInt64()
+	assert.Equal(t, int64(1), v)
+	b, _ := reader.Read()
+	assert.Equal(t, "two", string(b))
+	assert.Equal(t, 0, reader.Remaining())
+}
+
+func TestOpError(t *testing.T) {
+	e, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	_, _, _, err = e.Receive(time.Millisecond)
+	var opErr *OpError
+	if assert.ErrorAs(t, err, &opErr) {
+		assert.Equal(t, OpReceive, opErr.Op)
+		assert.Equal(t, e.LocalAddress(), opErr.LocalAddr)
+	}
+	assert.True(t, IsTimeout(err))
+	e.Close()
+	err = e.Send(e.Writer(), e.LocalAddress(), 0)
+	if assert.ErrorAs(t, err, &opErr) {
+		assert.Equal(t, OpSend, opErr.Op)
+	}
+	assert.True(t, IsClosed(err))
+}
+
+func TestReceiveType(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Send a mix of types, each with a distinct value.
+	//
+	for i, msgType := range []uint8{2, 1, 3, 2, 1} {
+		w := sender.Writer()
+		w.WriteUint8(msgType)
+		w.WriteUint16(uint16(i))
+		assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	for _, want := range []uint16{1, 4} {
+		reader, addr, err := receiver.ReceiveType(1, 20*time.Millisecond)
+		assert.Nil(t, err)
+		assert.NotNil(t, addr)
+		msgType, _ := reader.ReadUint8()
+		assert.Equal(t, uint8(1), msgType)
+		v, _ := reader.ReadUint16()
+		assert.Equal(t, want, v)
+		reader.Close()
+	}
+	reader, addr, err := receiver.ReceiveType(1, 20*time.Millisecond)
+	assert.Nil(t, reader)
+	assert.Nil(t, addr)
+	assert.True(t, IsTimeout(err))
+}
+
+func TestEcho(t *testing.T) {
+	echo, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer echo.Close()
+	client, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- echo.Echo(ctx)
+	}()
+	w := client.Writer()
+	w.WriteUint64(42)
+	w.WriteVarString("echo")
+	assert.Nil(t, client.Send(w, echo.LocalAddress(), 20*time.Millisecond))
+	reader, addr, _, err := client.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, echo.LocalPort(), addr.Port)
+	v, _ := reader.ReadUint64()
+	assert.Equal(t, uint64(42), v)
+	s, _ := reader.ReadVarString()
+	assert.Equal(t, "echo", s)
+	assert.Equal(t, 0, reader.Remaining())
+	reader.Close()
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestPortAssigned(t *testing.T) {
+	var port int
+	e, err := NewEndpoint(&testprotocol, 0, 8, WithPortAssigned(func(p int) { port = p }))
+	assert.Nil(t, err)
+	defer e.Close()
+	assert.NotZero(t, port)
+	assert.Equal(t, e.LocalPort(), port)
+}
+
+func TestUvarintSlice(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	for _, vs := range [][]uint64{{}, {0, 1, 127, 128, 300, 1 << 40, math.MaxUint64}} {
+		w := sender.Writer()
+		assert.Nil(t, w.WriteUvarintSlice(vs))
+		assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+		reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		v, err := reader.ReadUvarintSlice()
+		assert.Nil(t, err)
+		assert.Equal(t, vs, v)
+		assert.Equal(t, 0, reader.Remaining())
+		reader.Close()
+	}
+	//
+	// A count larger than the remaining bytes is rejected.
+	//
+	w := sender.Writer()
+	w.WriteUint8(5)
+	w.WriteUint8(1)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	_, err = reader.ReadUvarintSlice()
+	assert.Equal(t, ErrOverflow, err)
+	reader.Close()
+}
+
+func TestSendContext(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	//
+	// A rate limit of one per second makes the second send wait.
+	//
+	sender, err := NewEndpoint(&testprotocol, 0, 8, WithRateLimit(1, 1))
+	assert.Nil(t, err)
+	defer sender.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Nil(t, sender.SendContext(ctx, sender.Writer(), receiver.LocalAddress()))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	err = sender.SendContext(ctx, sender.Writer(), receiver.LocalAddress())
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.ErrorIs(t, err, context.Canceled)
+	var opErr *OpError
+	assert.ErrorAs(t, err, &opErr)
+	//
+	// An expired context is not sent at all.
+	//
+	err = sender.SendContext(ctx, sender.Writer(), receiver.LocalAddress())
+	assert.ErrorIs(t, err, context.Canceled)
+	//
+	// A context done during the send leaves no deadline for later sends.
+	//
+	plain, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer plain.Close()
+	for i := 0; i < 20; i++ {
+		plain.SendContext(doneContext{Context: context.Background()}, plain.Writer(), receiver.LocalAddress())
+		time.Sleep(time.Millisecond) // Give any watcher left behind time to run.
+		assert.Nil(t, plain.Send(plain.Writer(), receiver.LocalAddress(), 0))
+	}
+}
+
+// A doneContext is done without saying so in Err, as if it had been cancelled
+// during the send.
+type doneContext struct {
+	context.Context
+}
+
+var closedChan = func() chan struct{} { ch := make(chan struct{}); close(ch); return ch }()
+
+func (doneContext) Done() <-chan struct{} { return closedChan }
+
+func TestProtocolFromSchema(t *testing.T) {
+	type quote struct {
+		Side   uint8
+		Size   uint16
+		Price  float64
+		Time   int64
+		Symbol string `datagram:"12"`
+		Venue  []byte `datagram:"4"`
+		Levels [3]uint64
+		Note   string `datagram:"-"`
+	}
+	p, err := ProtocolFromSchema(&quote{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(16+1+2+8+8+(2+12)+(2+4)+3*8), p.Payload)
+	//
+	// The payload allows for the headers, so the schema fits when hashed and
+	// sequenced.
+	//
+	p.HashString = "quote/v1"
+	p.Sequenced = true
+	assert.True(t, p.Fits(int(p.Payload)-16))
+	//
+	// Untagged strings and unsupported types are rejected.
+	//
+	_, err = ProtocolFromSchema(struct{ Name string }{})
+	assert.Equal(t, ErrInvalidSchema, err)
+	_, err = ProtocolFromSchema(struct{ Flag bool }{})
+	assert.Equal(t, ErrInvalidSchema, err)
+	_, err = ProtocolFromSchema(42)
+	assert.Equal(t, ErrInvalidSchema, err)
+}
+
+func TestReceiveOnly(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8, WithReceiveOnly())
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	w.WriteUint64(7)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	v, _ := reader.ReadUint64()
+	assert.Equal(t, uint64(7), v)
+	reader.Close()
+	//
+	// Writing and sending fail.
+	//
+	receiver.Warm()
+	w = receiver.Writer()
+	assert.Equal(t, ErrReceiveOnly, w.WriteUint64(7))
+	assert.Equal(t, ErrReceiveOnly, w.Write([]byte{7}))
+	assert.Equal(t, ErrReceiveOnly, w.WriteStringSlice([]string{"7"}))
+	assert.Equal(t, 0, w.Remaining())
+	assert.Equal(t, ErrReceiveOnly, receiver.Send(w, sender.LocalAddress(), 20*time.Millisecond))
+	assert.Equal(t, ErrReceiveOnly, receiver.SendBytes([]byte{1}, sender.LocalAddress(), 20*time.Millisecond))
+}
+
+func TestSendOnly(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8, WithSendOnly())
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	w.WriteUint64(7)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	v, _ := reader.ReadUint64()
+	assert.Equal(t, uint64(7), v)
+	reader.Close()
+	//
+	// Receiving fails.
+	//
+	reader, addr, _, err := sender.Receive(20 * time.Millisecond)
+	assert.Nil(t, reader)
+	assert.Nil(t, addr)
+	assert.Equal(t, ErrSendOnly, err)
+	_, ok := <-sender.Datagrams(context.Background())
+	assert.False(t, ok)
+}
+
+func TestChecksumHeaders(t *testing.T) {
+	for _, headers := range []bool{false, true} {
+		protocol := &Protocol{HashString: "checksum/v1", Sequenced: true, Payload: 64, Checksum: true, ChecksumHeaders: headers}
+		var reasons []string
+		receiver, err := NewEndpoint(protocol, 0, 8, WithOnReject(func(_ *net.UDPAddr, reason string) {
+			reasons = append(reasons, reason)
+		}))
+		assert.Nil(t, err)
+		sender, err := NewEndpoint(protocol, 0, 8)
+		assert.Nil(t, err)
+		//
+		// Capture a datagram so that it can be altered.
+		//
+		raw, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.Nil(t, err)
+		w := sender.Writer()
+		assert.Equal(t, 64-16-4, w.Remaining())
+		w.WriteUint64(99)
+		assert.Nil(t, sender.Send(w, raw.LocalAddr().(*net.UDPAddr), 20*time.Millisecond))
+		captured := make([]byte, 64)
+		raw.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		n, _, err := raw.ReadFromUDP(captured)
+		assert.Nil(t, err)
+		assert.Equal(t, 16+8+4, n)
+		captured = captured[:n]
+		to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()}
+		//
+		// The unaltered datagram is accepted, with the checksum removed.
+		//
+		_, err = raw.WriteToUDP(captured, to)
+		assert.Nil(t, err)
+		reader, _, seq, err := receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1), seq)
+		v, _ := reader.ReadUint64()
+		assert.Equal(t, uint64(99), v)
+		assert.Equal(t, 0, reader.Remaining())
+		reader.Close()
+		//
+		// Flip a byte of the sequence number in the header.
+		//
+		captured[15] ^= 0xFF
+		_, err = raw.WriteToUDP(captured, to)
+		assert.Nil(t, err)
+		reader, _, _, err = receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		if headers {
+			assert.Nil(t, reader)
+			assert.Equal(t, []string{RejectChecksum}, reasons)
+		} else {
+			assert.NotNil(t, reader)
+			assert.Empty(t, reasons)
+			reader.Close()
+		}
+		//
+		// Flipping a body byte is always detected.
+		//
+		reasons = nil
+		captured[16] ^= 0xFF
+		_, err = raw.WriteToUDP(captured, to)
+		assert.Nil(t, err)
+		reader, _, _, err = receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		assert.Nil(t, reader)
+		assert.Equal(t, []string{RejectChecksum}, reasons)
+		raw.Close()
+		sender.Close()
+		receiver.Close()
+	}
+}
+
+func TestChecksumPadTo(t *testing.T) {
+	protocol := &Protocol{Payload: 64, PadTo: 32, ChecksumHeaders: true}
+	receiver, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	assert.Equal(t, 32-2-4, w.Remaining())
+	w.WriteUint16(7)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 32, reader.DatagramLen())
+	v, _ := reader.ReadUint16()
+	assert.Equal(t, uint16(7), v)
+	assert.Equal(t, 0, reader.Remaining())
+	reader.Close()
+}
+
+func TestRawHeader(t *testing.T) {
+	protocol := &Protocol{HashString: "raw/v1", Sequenced: true, Payload: 64}
+	receiver, err := NewEndpoint(protocol, 0, 8, WithRawRead())
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	sender.SetSequence(41)
+	w := sender.Writer()
+	w.WriteUint16(7)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, seq, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Zero(t, seq)
+	assert.Equal(t, 16+2, reader.Remaining())
+	hash, seq, err := reader.RawHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.hash(), hash)
+	assert.Equal(t, uint64(42), seq)
+	v, _ := reader.ReadUint16()
+	assert.Equal(t, uint16(7), v)
+	reader.Close()
+	//
+	// Payloads with a different hash are still delivered.
+	//
+	other, err := NewEndpoint(&Protocol{HashString: "other/v1", Sequenced: true, Payload: 64}, 0, 8)
+	assert.Nil(t, err)
+	defer other.Close()
+	assert.Nil(t, other.Send(other.Writer(), receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err = receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	hash, _, err = reader.RawHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, (&Protocol{HashString: "other/v1"}).hash(), hash)
+	reader.Close()
+}
+
+func TestMaxReceiveBody(t *testing.T) {
+	protocol := &Protocol{HashString: "max/v1", Payload: 64}
+	receiver, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	receiver.SetMaxReceiveBody(8)
+	for _, size := range []int{8, 9} {
+		w := sender.Writer()
+		w.buffer.Write(make([]byte, size))
+		assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, reader.Remaining())
+	reader.Close()
+	reader, addr, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Equal(t, ErrOversize, err)
+	assert.Nil(t, reader)
+	assert.Nil(t, addr)
+}
+
+func TestUnixSeconds(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	known := time.Date(2024, 2, 29, 12, 34, 56, 789, time.UTC)
+	last := time.Unix(math.MaxUint32, 0)
+	w := sender.Writer()
+	assert.Nil(t, w.WriteUnixSeconds(known))
+	assert.Nil(t, w.WriteUnixSeconds(last))
+	assert.Nil(t, w.WriteUnixSeconds(last.Add(time.Second)))
+	assert.Equal(t, 256-12, w.Remaining())
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	v, err := reader.ReadUnixSeconds()
+	assert.Nil(t, err)
+	assert.True(t, known.Truncate(time.Second).Equal(v))
+	v, err = reader.ReadUnixSeconds()
+	assert.Nil(t, err)
+	assert.True(t, last.Equal(v))
+	//
+	// One second past the last representable time rolls over to 1970.
+	//
+	v, err = reader.ReadUnixSeconds()
+	assert.Nil(t, err)
+	assert.True(t, time.Unix(0, 0).Equal(v))
+	_, err = reader.ReadUnixSeconds()
+	assert.NotNil(t, err)
+}
+
+func TestAssertEmpty(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	for i := 0; i < 2; i++ {
+		w := sender.Writer()
+		w.WriteUint16(1)
+		w.WriteUint64(2)
+		assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	//
+	// Decode every field.
+	//
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	reader.ReadUint16()
+	reader.ReadUint64()
+	assert.Nil(t, reader.AssertEmpty())
+	reader.Close()
+	//
+	// Miss the last field.
+	//
+	reader, _, _, err = receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	reader.ReadUint16()
+	assert.Equal(t, ErrTrailingData, reader.AssertEmpty())
+	reader.Close()
+	assert.Equal(t, ErrClosedReader, reader.AssertEmpty())
+}
+
+func TestSendTemplate(t *testing.T) {
+	protocol := &Protocol{HashString: "template/v1", Sequenced: true, Payload: 64}
+	receiver, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	w.WriteUint8(7)
+	w.WriteVarString("prefix")
+	tmpl := w.Template()
+	assert.Equal(t, 1+1+6, len(tmpl))
+	for i := uint64(1); i <= 3; i++ {
+		err = sender.SendTemplate(tmpl, func(w *Writer) error {
+			return w.WriteUint64(i * 10)
+		}, receiver.LocalAddress(), 20*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		reader, _, seq, err := receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		assert.Equal(t, i+1, seq)
+		v, _ := reader.ReadUint8()
+		assert.Equal(t, uint8(7), v)
+		s, _ := reader.ReadVarString()
+		assert.Equal(t, "prefix", s)
+		n, _ := reader.ReadUint64()
+		assert.Equal(t, i*10, n)
+		assert.Nil(t, reader.AssertEmpty())
+		reader.Close()
+	}
+	//
+	// An error from the extra function stops the send.
+	//
+	err = sender.SendTemplate(tmpl, func(w *Writer) error {
+		return w.Write(make([]byte, 64))
+	}, receiver.LocalAddress(), 20*time.Millisecond)
+	assert.Equal(t, ErrOverflow, err)
+}
+
+func TestReadOverflow(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// A length prefix of 100 followed by only 10 bytes.
+	//
+	w := sender.Writer()
+	w.WriteUint16(100)
+	w.buffer.Write(make([]byte, 10))
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	v, err := reader.Read()
+	assert.Equal(t, ErrOverflow, err)
+	assert.Nil(t, v)
+}
+
+func benchmarkReceiveBurst(b *testing.B, options ...func(*Endpoint)) {
+	const burst = 32
+	receiver, _ := NewEndpoint(&testprotocol, 0, 8, options...)
+	defer receiver.Close()
+	sender, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer sender.Close()
+	body := make([]byte, 200)
+	readers := make([]*Reader, burst)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < burst; j++ {
+			sender.SendBytes(body, receiver.LocalAddress(), 0)
+		}
+		for j := range readers {
+			readers[j], _, _, _ = receiver.Receive(time.Second)
+		}
+		for _, reader := range readers {
+			if reader != nil {
+				reader.Close()
+			}
+		}
+	}
+}
+
+func BenchmarkReceiveBurst(b *testing.B) {
+	benchmarkReceiveBurst(b)
+}
+
+func BenchmarkReceiveBurstArena(b *testing.B) {
+	benchmarkReceiveBurst(b, WithArena(64))
+}
+
+func TestArena(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 2, WithArena(4))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Hold more readers than the pool size, so that new buffers are taken from
+	// the arena, and check that none overlap.
+	//
+	readers := make([]*Reader, 6)
+	for i := range readers {
+		w := sender.Writer()
+		w.buffer.Write(bytes.Repeat([]byte{byte(i)}, 256))
+		assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+		readers[i], _, _, err = receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+	}
+	for i, reader := range readers {
+		assert.Equal(t, 256, reader.buffer.Cap())
+		v, _ := reader.ReadAll()
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 256), v)
+		reader.Close()
+	}
+}
+
+func TestSendAddrPort(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	to := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(receiver.LocalPort()))
+	w := sender.Writer()
+	w.WriteUint64(7)
+	assert.Nil(t, sender.SendAddrPort(w, to, 20*time.Millisecond))
+	reader, addr, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, sender.LocalPort(), addr.Port)
+	v, _ := reader.ReadUint64()
+	assert.Equal(t, uint64(7), v)
+	reader.Close()
+}
+
+func benchmarkSendAddrPort(b *testing.B, convert bool) {
+	receiver, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer receiver.Close()
+	sender, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer sender.Close()
+	to := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(receiver.LocalPort()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := sender.Writer()
+		w.WriteUint64(uint64(i))
+		if convert {
+			sender.Send(w, net.UDPAddrFromAddrPort(to), 0)
+		} else {
+			sender.SendAddrPort(w, to, 0)
+		}
+	}
+}
+
+func BenchmarkSendUDPAddr(b *testing.B) {
+	benchmarkSendAddrPort(b, true)
+}
+
+func BenchmarkSendAddrPort(b *testing.B) {
+	benchmarkSendAddrPort(b, false)
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	e, err := NewEndpoint(&testprotocol, 0, 8, WithDontFragment())
+	assert.Nil(t, err)
+	e.Close()
+	//
+	// Simulate the error from a send larger than the path MTU.
+	//
+	sys := &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", syscall.EMSGSIZE)}
+	err = classifySend(sys, 1500)
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+	assert.ErrorIs(t, err, syscall.EMSGSIZE)
+	var tooLarge *MessageTooLargeError
+	if assert.ErrorAs(t, err, &tooLarge) {
+		assert.Equal(t, 1500, tooLarge.Size)
+	}
+	assert.Equal(t, "message too large: 1500 bytes", err.Error())
+	//
+	// Other errors are left alone.
+	//
+	assert.Equal(t, net.ErrClosed, classifySend(net.ErrClosed, 1500))
+}
+
+func TestRepeated(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	assert.Nil(t, w.WriteRepeated(0xFF, 1_000_000))
+	assert.Equal(t, 256-4, w.Remaining())
+	assert.Nil(t, w.WriteRepeated(0, 0))
+	assert.Equal(t, ErrInvalidLength, w.WriteRepeated(0, -1))
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	b, count, err := reader.ReadRepeated()
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0xFF), b)
+	assert.Equal(t, 1_000_000, count)
+	b, count, err = reader.ReadRepeated()
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0), b)
+	assert.Equal(t, 0, count)
+	assert.Nil(t, reader.AssertEmpty())
+}
+
+func TestChecksumXXHash64(t *testing.T) {
+	protocol := &Protocol{HashString: "xxhash/v1", Payload: 64, ChecksumHeaders: true, ChecksumAlgorithm: ChecksumXXHash64}
+	var reasons []string
+	receiver, err := NewEndpoint(protocol, 0, 8, WithOnReject(func(_ *net.UDPAddr, reason string) {
+		reasons = append(reasons, reason)
+	}))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	assert.Equal(t, 64-8-8, w.Remaining())
+	w.WriteUint64(99)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 8+8+8, reader.DatagramLen())
+	v, _ := reader.ReadUint64()
+	assert.Equal(t, uint64(99), v)
+	assert.Nil(t, reader.AssertEmpty())
+	reader.Close()
+	//
+	// A CRC32C receiver rejects the same datagram.
+	//
+	crc, err := NewEndpoint(&Protocol{HashString: "xxhash/v1", Payload: 64, ChecksumHeaders: true}, 0, 8, WithOnReject(func(_ *net.UDPAddr, reason string) {
+		reasons = append(reasons, reason)
+	}))
+	assert.Nil(t, err)
+	defer crc.Close()
+	w = sender.Writer()
+	w.WriteUint64(99)
+	assert.Nil(t, sender.Send(w, crc.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err = crc.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, reader)
+	assert.Equal(t, []string{RejectChecksum}, reasons)
+}
+
+func benchmarkChecksum(b *testing.B, algorithm ChecksumAlgorithm) {
+	p := &Protocol{Payload: MaxPayload, Checksum: true, ChecksumAlgorithm: algorithm}
+	payload := make([]byte, MaxPayload)
+	sum := make([]byte, p.checksumSize())
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.checksum(payload, sum)
+	}
+}
+
+func BenchmarkChecksumCRC32C(b *testing.B) {
+	benchmarkChecksum(b, ChecksumCRC32C)
+}
+
+func BenchmarkChecksumXXHash64(b *testing.B) {
+	benchmarkChecksum(b, ChecksumXXHash64)
+}
+
+func TestReceiveRing(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8, WithReaderRing(2))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	for i := 0; i < 4; i++ {
+		w := sender.Writer()
+		w.WriteUint64(uint64(i))
+		assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	ring := receiver.Ring()
+	first, _, _, err := receiver.ReceiveRing(20 * time.Millisecond)
+	assert.Nil(t, err)
+	second, _, _, err := receiver.ReceiveRing(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, ring.Free())
+	//
+	// The ring is full until the first reader is closed, which is then reused.
+	//
+	_, _, _, err = receiver.ReceiveRing(20 * time.Millisecond)
+	assert.Equal(t, ErrRingFull, err)
+	v, _ := first.ReadUint64()
+	assert.Equal(t, uint64(0), v)
+	first.Close()
+	assert.Equal(t, 1, ring.Free())
+	third, _, _, err := receiver.ReceiveRing(20 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Same(t, first, third)
+	v, _ = third.ReadUint64()
+	assert.Equal(t, uint64(2), v)
+	v, _ = second.ReadUint64()
+	assert.Equal(t, uint64(1), v)
+	second.Close()
+	third.Close()
+	assert.Equal(t, 2, ring.Free())
+}
+
+func TestReceiveRingConcurrentClose(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8, WithReaderRing(4))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Readers are closed on another goroutine while the ring is reused, which
+	// the race detector checks.
+	//
+	ch := make(chan *Reader, 4)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for reader := range ch {
+			reader.ReadUint64()
+			reader.Close()
+		}
+	}()
+	for i := 0; i < 100; {
+		if i%4 == 0 {
+			for j := 0; j < 4; j++ {
+				w := sender.Writer()
+				w.WriteUint64(uint64(i + j))
+				assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+			}
+		}
+		reader, _, _, err := receiver.ReceiveRing(time.Second)
+		if err == ErrRingFull {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		assert.Nil(t, err)
+		if assert.NotNil(t, reader) {
+			ch <- reader
+		}
+		i++
+		receiver.Ring().Free()
+	}
+	close(ch)
+	<-done
+	assert.Equal(t, 4, receiver.Ring().Free())
+}
+
+func benchmarkReceiveRing(b *testing.B, options ...func(*Endpoint)) {
+	receiver, _ := NewEndpoint(&testprotocol, 0, 8, options...)
+	defer receiver.Close()
+	sender, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer sender.Close()
+	body := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		sender.SendBytes(body, receiver.LocalAddress(), 0)
+		b.StartTimer()
+		reader, _, _, _ := receiver.ReceiveRing(time.Second)
+		if reader != nil {
+			reader.Close()
+		}
+	}
+}
+
+func BenchmarkReceive(b *testing.B) {
+	benchmarkReceiveRing(b)
+}
+
+func BenchmarkReceiveRing(b *testing.B) {
+	benchmarkReceiveRing(b, WithReaderRing(4))
+}
+
+func TestReadInt64Into(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	values := []int64{math.MinInt64, -1, 0, 1, math.MaxInt64}
+	w := sender.Writer()
+	assert.Nil(t, w.WriteInt64Slice(values))
+	assert.Equal(t, 256-1-8*len(values), w.Remaining())
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	//
+	// A slice that is too small is refused.
+	//
+	dst := make([]int64, 8)
+	_, err = reader.Clone().ReadInt64Into(dst[:4])
+	assert.Equal(t, io.ErrShortBuffer, err)
+	frame := reader.buffer.Bytes()
+	clone := &Reader{buffer: new(bytes.Buffer), endpoint: receiver, clone: true}
+	clone.buffer.Grow(len(frame))
+	var n int
+	allocs := testing.AllocsPerRun(10, func() {
+		clone.buffer.Reset()
+		clone.buffer.Write(frame)
+		n, err = clone.ReadInt64Into(dst)
+	})
+	assert.Zero(t, allocs)
+	assert.Nil(t, err)
+	assert.Equal(t, values, dst[:n])
+}
+
+func TestReadUvarintTruncated(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	//
+	// A payload that ends before the uvarint prefix is truncated, as with any
+	// other field.
+	//
+	empty := func() *Reader {
+		return &Reader{buffer: new(bytes.Buffer), endpoint: receiver, clone: true}
+	}
+	_, err = empty().ReadVarBytes()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = empty().ReadVarString()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = empty().ReadUvarintSlice()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = empty().ReadInt64Into(make([]int64, 1))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestWriterSaveRestore(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Try a compact encoding, abandon it and use the full one instead.
+	//
+	w := sender.Writer()
+	w.WriteUint8(1)
+	mark := w.Save()
+	w.WriteUint8(2)
+	w.WriteUint16(300)
+	assert.Nil(t, w.Restore(mark))
+	assert.Equal(t, mark, w.Len())
+	w.WriteUint8(3)
+	w.WriteUint64(300)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	v, _ := reader.ReadUint8()
+	assert.Equal(t, uint8(1), v)
+	v, _ = reader.ReadUint8()
+	assert.Equal(t, uint8(3), v)
+	n, _ := reader.ReadUint64()
+	assert.Equal(t, uint64(300), n)
+	assert.Nil(t, reader.AssertEmpty())
+}
+
+func TestRangePeers(t *testing.T) {
+	protocol := &Protocol{Sequenced: true, Payload: 64}
+	receiver, err := NewEndpoint(protocol, 0, 8, WithPeerTracking())
+	assert.Nil(t, err)
+	defer receiver.Close()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()}
+	want := make(map[netip.AddrPort]uint64)
+	for i, count := range []int{2, 5} {
+		sender, err := NewEndpoint(protocol, 0, 8)
+		assert.Nil(t, err)
+		defer sender.Close()
+		sender.SetSequence(uint64(100 * i))
+		for j := 0; j < count; j++ {
+			assert.Nil(t, sender.Send(sender.Writer(), to, 20*time.Millisecond))
+			reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+			assert.Nil(t, err)
+			reader.Close()
+		}
+		key := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(sender.LocalPort()))
+		want[key] = sender.LastSequence()
+	}
+	got := make(map[netip.AddrPort]uint64)
+	receiver.RangePeers(func(addr netip.AddrPort, lastSeq uint64) bool {
+		got[addr] = lastSeq
+		return true
+	})
+	assert.Equal(t, want, got)
+	//
+	// Returning false stops the iteration.
+	//
+	calls := 0
+	receiver.RangePeers(func(netip.AddrPort, uint64) bool {
+		calls++
+		return false
+	})
+	assert.Equal(t, 1, calls)
+}
+
+func TestShutdown(t *testing.T) {
+	e, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer e.Close()
+	done := make(chan error)
+	go func() {
+		_, _, _, err := e.Receive(0)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, e.Shutdown())
+	select {
+	case err = <-done:
+		assert.Equal(t, ErrShutdown, err)
+	case <-time.After(time.Second):
+		t.Fatal("receive not unblocked")
+	}
+	assert.False(t, IsClosed(err))
+	//
+	// Later receives fail at once, but the end point can still send.
+	//
+	_, _, _, err = e.Receive(time.Second)
+	assert.Equal(t, ErrShutdown, err)
+	assert.Nil(t, e.Send(e.Writer(), e.LocalAddress(), 20*time.Millisecond))
+}
+
+func TestFrameLengthBytes(t *testing.T) {
+	for _, width := range []int{1, 2, 4} {
+		protocol := &Protocol{Payload: 600, FrameLengthBytes: width}
+		receiver, err := NewEndpoint(protocol, 0, 8)
+		assert.Nil(t, err)
+		sender, err := NewEndpoint(protocol, 0, 8)
+		assert.Nil(t, err)
+		frame := bytes.Repeat([]byte{0xAB}, 255)
+		w := sender.Writer()
+		assert.Nil(t, w.Write(frame))
+		assert.Equal(t, width+255, w.Len())
+		if width == 1 {
+			assert.Equal(t, ErrOverflow, w.Write(make([]byte, 256)))
+		} else {
+			assert.Nil(t, w.Write(make([]byte, 256)))
+		}
+		assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+		reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		v, err := reader.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, frame, v)
+		if width > 1 {
+			v, err = reader.Read()
+			assert.Nil(t, err)
+			assert.Equal(t, 256, len(v))
+		}
+		assert.Nil(t, reader.AssertEmpty())
+		reader.Close()
+		//
+		// A length beyond the body is rejected whatever the width.
+		//
+		w = sender.Writer()
+		w.buffer.Write(bytes.Repeat([]byte{0xFF}, width))
+		w.buffer.Write(make([]byte, 10))
+		assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+		reader, _, _, err = receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		_, err = reader.Read()
+		assert.Equal(t, ErrOverflow, err)
+		reader.Close()
+		sender.Close()
+		receiver.Close()
+	}
+	assert.Panics(t, func() { NewEndpoint(&Protocol{Payload: 64, FrameLengthBytes: 3}, 0, 8) })
+}
+
+type testQuote struct {
+	symbol string
+	price  float64
+	size   uint64
+}
+
+func (q *testQuote) EncodeTo(w *Writer) (err error) {
+	if err = w.WriteVarString(q.symbol); err != nil {
+		return
+	}
+	if err = w.WriteFloat64(q.price); err != nil {
+		return
+	}
+	return w.WriteUint64(q.size)
+}
+
+func (q *testQuote) DecodeFrom(r *Reader) (err error) {
+	if q.symbol, err = r.ReadVarString(); err != nil {
+		return
+	}
+	if q.price, err = r.ReadFloat64(); err != nil {
+		return
+	}
+	q.size, err = r.ReadUint64()
+	return
+}
+
+func TestEncodeDecode(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	want := testQuote{symbol: "ABC", price: 1.25, size: 100}
+	w := sender.Writer()
+	assert.Nil(t, w.Encode(&want))
+	//
+	// A failed encoding leaves nothing behind.
+	//
+	n := w.Len()
+	assert.Equal(t, ErrOverflow, w.Encode(&testQuote{symbol: strings.Repeat("x", 240)}))
+	assert.Equal(t, n, w.Len())
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	var got testQuote
+	assert.Nil(t, reader.Decode(&got))
+	assert.Equal(t, want, got)
+	assert.Nil(t, reader.AssertEmpty())
+}
+
+func TestRuneString(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	s := "héllo, 世界 🌍"
+	w := sender.Writer()
+	assert.Nil(t, w.WriteRuneString(s))
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	//
+	// The prefix has the rune count and then the byte count.
+	//
+	prefix := reader.buffer.Bytes()[:4]
+	assert.Equal(t, []byte{0, 11, 0, byte(len(s))}, prefix)
+	v, err := reader.ReadRuneString()
+	assert.Nil(t, err)
+	assert.Equal(t, s, v)
+	assert.Nil(t, reader.AssertEmpty())
+}
+
+func TestReadUvarintCanonical(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	for _, tc := range []struct {
+		encoded []byte
+		want    uint64
+		err     error
+	}{
+		{[]byte{0x00}, 0, nil},
+		{[]byte{0x7F}, 127, nil},
+		{[]byte{0x80, 0x01}, 128, nil},
+		{[]byte{0x80, 0x00}, 0, ErrNonCanonical},
+		{[]byte{0x81, 0x80, 0x00}, 0, ErrNonCanonical},
+		{[]byte{0x80}, 0, io.ErrUnexpectedEOF},
+	} {
+		assert.Nil(t, sender.SendBytes(tc.encoded, receiver.LocalAddress(), 20*time.Millisecond))
+		reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		v, err := reader.ReadUvarintCanonical()
+		assert.Equal(t, tc.err, err, tc.encoded)
+		assert.Equal(t, tc.want, v, tc.encoded)
+		if err == nil {
+			assert.Nil(t, reader.AssertEmpty())
+		} else {
+			assert.Equal(t, len(tc.encoded), reader.Remaining())
+		}
+		reader.Close()
+	}
+}
+
+func TestPacing(t *testing.T) {
+	const gap = 2 * time.Millisecond
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8, WithPacing(gap))
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Each send starts at least a gap after the one before, so five sends take
+	// at least four gaps however long the writes take.
+	//
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, sender.Send(sender.Writer(), receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 4*gap)
+	//
+	// A send that would wait longer than its timeout is refused.
+	//
+	slow, err := NewEndpoint(&testprotocol, 0, 8, WithPacing(time.Second))
+	assert.Nil(t, err)
+	defer slow.Close()
+	assert.Nil(t, slow.Send(slow.Writer(), receiver.LocalAddress(), 20*time.Millisecond))
+	assert.Equal(t, ErrRateLimited, slow.Send(slow.Writer(), receiver.LocalAddress(), 20*time.Millisecond))
+}
+
+func TestWriterBytes(t *testing.T) {
+	e, err := NewEndpoint(&Protocol{Hash: 0x0102030405060708, Sequenced: true, Payload: 64}, 0, 8)
+	assert.Nil(t, err)
+	defer e.Close()
+	w := e.Writer()
+	w.WriteUint16(0xABCD)
+	w.WriteUint8(0xEF)
+	want := []byte{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // Hash.
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // Sequence.
+		0xAB, 0xCD, 0xEF,
+	}
+	b := w.Bytes()
+	assert.Equal(t, want, b)
+	//
+	// The copy is independent of the writer.
+	//
+	b[0] = 0
+	w.WriteUint8(0x42)
+	assert.Equal(t, append(want, 0x42), w.Bytes())
+}
+
+func TestReassemble(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Encode a message, then split it so that fields straddle the fragments.
+	//
+	w := sender.Writer()
+	w.WriteUint16(1)
+	w.WriteUint64(0x0102030405060708)
+	w.WriteVarString("straddle")
+	w.WriteUint8(9)
+	message := w.Bytes()
+	for _, fragment := range [][]byte{message[:6], message[6:14], message[14:]} {
+		assert.Nil(t, sender.SendBytes(fragment, receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	var fragments []*Reader
+	for i := 0; i < 3; i++ {
+		reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		fragments = append(fragments, reader)
+	}
+	reader, err := receiver.Reassemble(fragments)
+	assert.Nil(t, err)
+	defer reader.Close()
+	assert.Equal(t, len(message), reader.Remaining())
+	assert.Nil(t, reader.Skip(2))
+	v, err := reader.ReadUint64()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0x0102030405060708), v)
+	s, err := reader.ReadVarString()
+	assert.Nil(t, err)
+	assert.Equal(t, "straddle", s)
+	b, _ := reader.ReadUint8()
+	assert.Equal(t, uint8(9), b)
+	assert.Nil(t, reader.AssertEmpty())
+	assert.Equal(t, io.ErrUnexpectedEOF, reader.Skip(1))
+	//
+	// The fragments have been closed.
+	//
+	assert.Equal(t, ErrClosedReader, fragments[0].Close())
+}
+
+func TestOneWayDelay(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	for i := 0; i < 2; i++ {
+		w := sender.Writer()
+		assert.Nil(t, w.WriteSendTime())
+		assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	delay, err := OneWayDelay(reader)
+	assert.Nil(t, err)
+	assert.Greater(t, delay, time.Duration(0))
+	assert.Less(t, delay, time.Second)
+	reader.Close()
+	reader, _, _, err = receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	sent, err := reader.ReadSendTime()
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), sent, time.Second)
+	reader.Close()
+}
+
+func TestReceiveWindow(t *testing.T) {
+	querier, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer querier.Close()
+	want := make(map[int]uint64)
+	for i := 0; i < 3; i++ {
+		responder, err := NewEndpoint(&testprotocol, 0, 8)
+		assert.Nil(t, err)
+		defer responder.Close()
+		w := responder.Writer()
+		w.WriteUint64(uint64(i))
+		assert.Nil(t, responder.Send(w, querier.LocalAddress(), 20*time.Millisecond))
+		want[responder.LocalPort()] = uint64(i)
+	}
+	got := make(map[int]uint64)
+	start := time.Now()
+	err = querier.ReceiveWindow(50*time.Millisecond, func(r *Reader, addr *net.UDPAddr) bool {
+		v, _ := r.ReadUint64()
+		got[addr.Port] = v
+		return true
+	})
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, want, got)
+	//
+	// Returning false ends the window early.
+	//
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, querier.Send(querier.Writer(), querier.LocalAddress(), 20*time.Millisecond))
+	}
+	calls := 0
+	err = querier.ReceiveWindow(time.Second, func(*Reader, *net.UDPAddr) bool {
+		calls++
+		return false
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestFEC(t *testing.T) {
+	sender, err := NewEndpoint(&testprotocol, 0, 8, WithFEC(4, 1))
+	assert.Nil(t, err)
+	defer sender.Close()
+	receiver, err := NewEndpoint(&testprotocol, 0, 8, WithFEC(4, 1))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	assert.Equal(t, int(testprotocol.Payload)-fecOverhead, receiver.Writer().Remaining()+testprotocol.headerSize())
+	//
+	// A lossy link which drops the second datagram of the first two groups.
+	//
+	link, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer link.Close()
+	for i := 0; i < 12; i++ {
+		w := sender.Writer()
+		w.WriteUint64(uint64(i))
+		w.Write(make([]byte, i)) // Vary the lengths.
+		assert.Nil(t, sender.Send(w, link.LocalAddr().(*net.UDPAddr), 20*time.Millisecond))
+	}
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()}
+	buf := make([]byte, testprotocol.Payload)
+	for i := 0; i < 15; i++ {
+		link.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := link.ReadFromUDP(buf)
+		assert.Nil(t, err)
+		if i == 1 || i == 6 {
+			continue
+		}
+		_, err = link.WriteToUDP(buf[:n], to)
+		assert.Nil(t, err)
+	}
+	got := make(map[uint64]bool)
+	for i := 0; i < 12; i++ {
+		r, _, _, err := receiver.Receive(time.Second)
+		assert.Nil(t, err)
+		assert.NotNil(t, r)
+		v, _ := r.ReadUint64()
+		b, _ := r.Read()
+		assert.Equal(t, int(v), len(b))
+		assert.Nil(t, r.AssertEmpty())
+		got[v] = true
+		r.Close()
+		switch i {
+		case 3, 7:
+			assert.Equal(t, uint64(i-2), v) // Rebuilt from the parity.
+		}
+	}
+	assert.Len(t, got, 12)
+	//
+	// The parity of the third group has nothing to recover.
+	//
+	r, _, _, err := receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+}
+
+func TestFECLate(t *testing.T) {
+	sender, err := NewEndpoint(&testprotocol, 0, 8, WithFEC(4, 1))
+	assert.Nil(t, err)
+	defer sender.Close()
+	receiver, err := NewEndpoint(&testprotocol, 0, 8, WithFEC(4, 1))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	//
+	// Capture two groups on the wire, then replay them out of order.
+	//
+	link, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer link.Close()
+	for i := 0; i < 8; i++ {
+		w := sender.Writer()
+		w.WriteUint64(uint64(i))
+		assert.Nil(t, sender.Send(w, link.LocalAddr().(*net.UDPAddr), 20*time.Millisecond))
+	}
+	var wire [][]byte
+	for i := 0; i < 10; i++ {
+		buf := make([]byte, testprotocol.Payload)
+		link.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := link.ReadFromUDP(buf)
+		assert.Nil(t, err)
+		wire = append(wire, buf[:n])
+	}
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()}
+	replay := func(i int) (v uint64, ok bool) {
+		_, err := link.WriteToUDP(wire[i], to)
+		assert.Nil(t, err)
+		r, _, _, err := receiver.Receive(time.Second)
+		assert.Nil(t, err)
+		if r == nil {
+			return 0, false
+		}
+		defer r.Close()
+		v, err = r.ReadUint64()
+		assert.Nil(t, err)
+		return v, true
+	}
+	var got []uint64
+	for _, i := range []int{0, 2, 3, 4} {
+		v, ok := replay(i)
+		assert.True(t, ok)
+		got = append(got, v)
+	}
+	assert.Equal(t, []uint64{0, 2, 3, 1}, got) // The second is rebuilt.
+	//
+	// The second arriving late, after it has been rebuilt, is dropped, as is
+	// a duplicate.
+	//
+	_, ok := replay(1)
+	assert.False(t, ok)
+	_, ok = replay(0)
+	assert.False(t, ok)
+	//
+	// Once the next group has started, the earlier one is dropped.
+	//
+	v, ok := replay(5)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(4), v)
+	_, ok = replay(3)
+	assert.False(t, ok)
+}
+
+func TestFECAddressLimit(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8, WithFEC(4, 1), WithAddressLimit(2))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8, WithFEC(4, 1), WithAddressLimit(1))
+	assert.Nil(t, err)
+	defer sender.Close()
+	other, err := NewEndpoint(&testprotocol, 0, 8, WithFEC(4, 1))
+	assert.Nil(t, err)
+	defer other.Close()
+	//
+	// The sender keeps state for one destination at a time.
+	//
+	for _, to := range []*Endpoint{other, receiver} {
+		assert.Nil(t, sender.Send(sender.Writer(), to.LocalAddress(), 20*time.Millisecond))
+	}
+	assert.Len(t, sender.fec.out, 1)
+	//
+	// The receiver keeps state for two sources, still delivering from more.
+	//
+	for i := 0; i < 2; i++ {
+		source, err := NewEndpoint(&testprotocol, 0, 8, WithFEC(4, 1))
+		assert.Nil(t, err)
+		defer source.Close()
+		assert.Nil(t, source.Send(source.Writer(), receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	for i := 0; i < 3; i++ {
+		r, _, _, err := receiver.Receive(time.Second)
+		assert.Nil(t, err)
+		if assert.NotNil(t, r) {
+			r.Close()
+		}
+	}
+	assert.Len(t, receiver.fec.in, 2)
+	assert.Panics(t, func() { NewEndpoint(&testprotocol, 0, 8, WithAddressLimit(0)) })
+}
+
+func TestOutstandingBuffers(t *testing.T) {
+	e, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer e.Close()
+	assert.Equal(t, 0, e.OutstandingBuffers())
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, e.Send(e.Writer(), e.LocalAddress(), 20*time.Millisecond))
+	}
+	assert.Equal(t, 0, e.OutstandingBuffers())
+	var readers []*Reader
+	for i := 0; i < 2; i++ {
+		r, _, _, err := e.Receive(time.Second)
+		assert.Nil(t, err)
+		assert.NotNil(t, r)
+		readers = append(readers, r)
+	}
+	assert.Equal(t, 2, e.OutstandingBuffers())
+	for _, r := range readers {
+		r.Close()
+	}
+	assert.Equal(t, 0, e.OutstandingBuffers())
+}
+
+func TestUUID(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	known := [16]byte{
+		0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3,
+		0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00,
+	}
+	w := sender.Writer()
+	assert.Nil(t, w.WriteUUID(known))
+	assert.Equal(t, 256-16, w.Remaining())
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	u, err := reader.ReadUUID()
+	assert.Nil(t, err)
+	assert.Equal(t, known, u)
+	_, err = reader.ReadUUID()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	//
+	// Nothing is written if the UUID does not fit.
+	//
+	w = sender.Writer()
+	defer sender.discard(w)
+	assert.Nil(t, w.Write(make([]byte, w.Remaining()-2-15)))
+	assert.ErrorIs(t, w.WriteUUID(known), ErrOverflow)
+	assert.Equal(t, 15, w.Remaining())
+}
+
+func TestRejectZeroSequence(t *testing.T) {
+	protocol := Protocol{HashString: "zero", Sequenced: true, Payload: 256, RejectZeroSequence: true}
+	var reasons []string
+	receiver, err := NewEndpoint(&protocol, 0, 8, WithOnReject(func(_ *net.UDPAddr, reason string) {
+		reasons = append(reasons, reason)
+	}))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&protocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// The first sequence number sent is one.
+	//
+	assert.Nil(t, sender.Send(sender.Writer(), receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, seq, err := receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	assert.NotNil(t, reader)
+	assert.Equal(t, uint64(1), seq)
+	reader.Close()
+	//
+	// A forged datagram with sequence number zero.
+	//
+	raw, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer raw.Close()
+	forged := binary.BigEndian.AppendUint64(nil, protocol.hash())
+	forged = binary.BigEndian.AppendUint64(forged, 0)
+	_, err = raw.WriteToUDP(forged, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()})
+	assert.Nil(t, err)
+	reader, _, _, err = receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, reader)
+	assert.Equal(t, []string{RejectSequence}, reasons)
+	assert.Equal(t, 0, receiver.OutstandingBuffers())
+}
+
+func TestSendReliable(t *testing.T) {
+	proto := &Protocol{
+		Hash:      42,
+		Sequenced: true,
+		Payload:   256,
+	}
+	receiver, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(proto, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	addr, _ := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(receiver.LocalPort()))
+	//
+	// The first attempt is received without an acknowledgment, so the payload
+	// is sent again.
+	//
+	seqs := make(chan uint64, 2)
+	go func() {
+		reader, _, seq, err := receiver.Receive(time.Second)
+		if err != nil || reader == nil {
+			return
+		}
+		reader.Close()
+		seqs <- seq
+		if reader, _, seq, err = receiver.ReceiveAndAck(time.Second); err != nil || reader == nil {
+			return
+		}
+		reader.Close()
+		seqs <- seq
+	}()
+	w := sender.Writer()
+	w.Write([]byte("reliable"))
+	assert.Nil(t, sender.SendReliable(w, addr, 50*time.Millisecond, 3))
+	assert.Equal(t, uint64(1), <-seqs)
+	assert.Equal(t, uint64(1), <-seqs) // The same payload.
+	//
+	// Without acknowledgments every attempt times out.
+	//
+	start := time.Now()
+	err = sender.SendReliable(sender.Writer(), addr, 20*time.Millisecond, 2)
+	assert.ErrorIs(t, err, ErrNotAcknowledged)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	//
+	// Acknowledgments need a sequence number.
+	//
+	unsequenced, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer unsequenced.Close()
+	assert.ErrorIs(t, unsequenced.SendReliable(unsequenced.Writer(), addr, time.Millisecond, 1), ErrUnsequenced)
+	_, _, _, err = unsequenced.ReceiveAndAck(time.Millisecond)
+	assert.ErrorIs(t, err, ErrUnsequenced)
+}
+
+func TestLossRate(t *testing.T) {
+	protocol := &Protocol{Sequenced: true, Payload: 64}
+	receiver, err := NewEndpoint(protocol, 0, 8, WithPeerTracking())
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()}
+	from := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(sender.LocalPort()))
+	assert.Equal(t, 0.0, receiver.LossRate(from))
+	//
+	// Drop every fourth sequence number.
+	//
+	for i := 1; i <= 200; i++ {
+		w := sender.Writer()
+		if i%4 == 0 {
+			sender.discard(w)
+			continue
+		}
+		assert.Nil(t, sender.Send(w, to, 20*time.Millisecond))
+		reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		reader.Close()
+		if i == 3 {
+			assert.Equal(t, 0.0, receiver.LossRate(from)) // Nothing lost yet.
+		}
+	}
+	assert.InDelta(t, 0.25, receiver.LossRate(from), 0.02)
+	assert.Equal(t, 0.0, receiver.LossRate(netip.MustParseAddrPort("127.0.0.1:1")))
+}
+
+func TestAlignTo(t *testing.T) {
+	protocol := &Protocol{HashString: "align", Sequenced: true, PadTo: 64, Payload: 64}
+	receiver, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	assert.Nil(t, w.WriteUint8(1))
+	assert.Nil(t, w.AlignTo(8))
+	body := w.Len() - protocol.headerSize()
+	assert.Equal(t, 8, body)
+	assert.Nil(t, w.WriteUint64(42))
+	assert.Nil(t, w.AlignTo(8)) // Already aligned.
+	assert.Equal(t, body+8, w.Len()-protocol.headerSize())
+	assert.Nil(t, w.WriteUint16(7))
+	assert.Nil(t, w.AlignTo(4))
+	assert.Nil(t, w.WriteUint16(9))
+	assert.ErrorIs(t, w.AlignTo(0), ErrInvalidLength)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	defer reader.Close()
+	v8, _ := reader.ReadUint8()
+	assert.Equal(t, uint8(1), v8)
+	assert.Nil(t, reader.AlignTo(8))
+	v64, err := reader.ReadUint64()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), v64)
+	assert.Nil(t, reader.AlignTo(8))
+	v16, _ := reader.ReadUint16()
+	assert.Equal(t, uint16(7), v16)
+	assert.Nil(t, reader.AlignTo(4))
+	v16, err = reader.ReadUint16()
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(9), v16)
+	assert.Nil(t, reader.AssertEmpty())
+}
+
+func TestReaderWriteTo(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	w.WriteUint16(1)
+	w.Write([]byte("forwarded body"))
+	want := w.Bytes()[2:]
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	defer reader.Close()
+	reader.ReadUint16()
+	var _ io.WriterTo = reader
+	var out bytes.Buffer
+	n, err := reader.WriteTo(&out)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(want)), n)
+	assert.Equal(t, want, out.Bytes())
+	assert.Equal(t, 0, reader.Remaining())
+	reader.Close()
+	_, err = reader.WriteTo(&out)
+	assert.ErrorIs(t, err, ErrClosedReader)
+}
+
+func TestList(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	want := make([]testQuote, 5)
+	for i := range want {
+		want[i] = testQuote{symbol: strings.Repeat("Q", i+1), price: float64(i) + 0.5, size: uint64(100 * i)}
+	}
+	w := sender.Writer()
+	assert.Nil(t, w.WriteList(len(want), func(w *Writer, i int) error {
+		return w.Encode(&want[i])
+	}))
+	//
+	// A failed element discards the whole list.
+	//
+	n := w.Len()
+	assert.ErrorIs(t, w.WriteList(3, func(w *Writer, i int) error {
+		if i == 2 {
+			return ErrInvalidSchema
+		}
+		return w.WriteUint8(uint8(i))
+	}), ErrInvalidSchema)
+	assert.Equal(t, n, w.Len())
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	var got []testQuote
+	count, err := reader.ReadList(func(r *Reader, i int) error {
+		var q testQuote
+		if err := r.Decode(&q); err != nil {
+			return err
+		}
+		got = append(got, q)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, count)
+	assert.Equal(t, want, got)
+	assert.Nil(t, reader.AssertEmpty())
+}
+
+func TestReceiveReuse(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()}
+	var last *Reader
+	for i := 0; i < 3; i++ {
+		w := sender.Writer()
+		w.WriteUint64(uint64(i))
+		assert.Nil(t, sender.Send(w, to, 20*time.Millisecond))
+		reader, addr, _, err := receiver.ReceiveReuse(time.Second)
+		assert.Nil(t, err)
+		assert.NotNil(t, reader)
+		if last != nil {
+			assert.Same(t, last, reader)
+		}
+		last = reader
+		assert.Equal(t, sender.LocalPort(), addr.Port)
+		assert.True(t, addr.IP.Equal(net.IPv4(127, 0, 0, 1)))
+		v, err := reader.ReadUint64()
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i), v)
+		if i == 1 {
+			reader.Close() // Closing is optional.
+		}
+	}
+	assert.Equal(t, 1, receiver.OutstandingBuffers())
+	last.Close()
+	assert.Equal(t, 0, receiver.OutstandingBuffers())
+}
+
+func BenchmarkReceiveReuse(b *testing.B) {
+	receiver, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer receiver.Close()
+	sender, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer sender.Close()
+	body := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		sender.SendBytes(body, receiver.LocalAddress(), 0)
+		b.StartTimer()
+		receiver.ReceiveReuse(time.Second)
+	}
+}
+
+func TestSendQueuedPriority(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	queue := func(v uint8, priority int) {
+		w := sender.Writer()
+		w.WriteUint8(v)
+		assert.Nil(t, sender.SendQueuedPriority(w, receiver.LocalAddress(), priority))
+	}
+	queue(1, 0) // Bulk.
+	queue(2, 0)
+	queue(3, 10) // Control.
+	queue(4, 5)
+	queue(5, 10)
+	assert.Nil(t, sender.FlushQueue(20*time.Millisecond))
+	var got []uint8
+	for i := 0; i < 5; i++ {
+		reader, _, _, err := receiver.Receive(time.Second)
+		assert.Nil(t, err)
+		v, _ := reader.ReadUint8()
+		got = append(got, v)
+		reader.Close()
+	}
+	assert.Equal(t, []uint8{3, 5, 4, 1, 2}, got)
+	assert.Nil(t, sender.FlushQueue(20*time.Millisecond)) // Nothing left.
+}
+
+func TestFieldCount(t *testing.T) {
+	protocol := &Protocol{HashString: "fields", Sequenced: true, Payload: 256}
+	receiver, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	w.WriteUint8(3) // The field count.
+	w.WriteUint64(42)
+	w.WriteVarString("name")
+	w.WriteFloat64(1.5)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	defer reader.Close()
+	assert.Equal(t, 0, reader.FieldsRead()) // The header is not counted.
+	n, err := reader.ReadUint8()
+	assert.Nil(t, err)
+	reader.ExpectFields(1 + int(n))
+	reader.ReadUint64()
+	reader.ReadVarString()
+	assert.ErrorIs(t, reader.AssertFieldCount(), ErrFieldCount)
+	reader.ReadFloat64()
+	assert.Equal(t, 4, reader.FieldsRead())
+	assert.Nil(t, reader.AssertFieldCount())
+	//
+	// Failed reads are not counted.
+	//
+	_, err = reader.ReadUint64()
+	assert.NotNil(t, err)
+	assert.Equal(t, 4, reader.FieldsRead())
+}
+
+func TestHeaderAndBody(t *testing.T) {
+	protocol := &Protocol{HashString: "split/v1", Sequenced: true, Payload: 64}
+	receiver, err := NewEndpoint(protocol, 0, 8, WithRawRead())
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	w := sender.Writer()
+	w.Write([]byte("body"))
+	want := w.Bytes()
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	header, body, err := reader.HeaderAndBody()
+	assert.Nil(t, err)
+	assert.Len(t, header, receiver.HeaderSize())
+	assert.Equal(t, want[:receiver.HeaderSize()], header)
+	assert.Equal(t, want[receiver.HeaderSize():], body)
+	assert.Equal(t, len(want), reader.Remaining()) // Nothing consumed.
+	_, seq, _ := reader.RawHeader()
+	assert.Equal(t, binary.BigEndian.Uint64(header[8:]), seq)
+	//
+	// Other readers have already consumed the header.
+	//
+	plain, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer plain.Close()
+	assert.Nil(t, sender.Send(sender.Writer(), plain.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err = plain.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	_, _, err = reader.HeaderAndBody()
+	assert.ErrorIs(t, err, ErrNotRawRead)
+}
+
+func TestTimestamped(t *testing.T) {
+	protocol := &Protocol{HashString: "stamp/v1", Timestamped: true, ClockSkew: time.Second, Payload: 64}
+	var reasons []string
+	receiver, err := NewEndpoint(protocol, 0, 8, WithOnReject(func(_ *net.UDPAddr, reason string) {
+		reasons = append(reasons, reason)
+	}))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	assert.Equal(t, 16, receiver.HeaderSize())
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()}
+	raw, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer raw.Close()
+	forge := func(at time.Time) {
+		b := binary.BigEndian.AppendUint64(nil, protocol.hash())
+		b = binary.BigEndian.AppendUint64(b, uint64(at.UnixNano()))
+		b = append(b, 7)
+		_, err := raw.WriteToUDP(b, to)
+		assert.Nil(t, err)
+	}
+	//
+	// A stale payload, perhaps replayed, is rejected.
+	//
+	forge(time.Now().Add(-time.Minute))
+	reader, _, _, err := receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, reader)
+	assert.Equal(t, []string{RejectStale}, reasons)
+	//
+	// A fresh one is received.
+	//
+	forge(time.Now())
+	reader, _, _, err = receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reader) {
+		v, _ := reader.ReadUint8()
+		assert.Equal(t, uint8(7), v)
+		reader.Close()
+	}
+	//
+	// As is one from an end point with the same protocol.
+	//
+	sender, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	assert.Nil(t, sender.Send(sender.Writer(), to, 20*time.Millisecond))
+	reader, _, _, err = receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reader) {
+		assert.Equal(t, 0, reader.Remaining())
+		reader.Close()
+	}
+	assert.Len(t, reasons, 1)
+	//
+	// The time is that of sending, so a writer held for longer than the skew,
+	// such as in the send queue, is not stale.
+	//
+	quick := &Protocol{HashString: "stamp/v1", Timestamped: true, ClockSkew: 50 * time.Millisecond, Payload: 64}
+	strict, err := NewEndpoint(quick, 0, 8, WithOnReject(func(_ *net.UDPAddr, reason string) {
+		reasons = append(reasons, reason)
+	}))
+	assert.Nil(t, err)
+	defer strict.Close()
+	held, err := NewEndpoint(quick, 0, 8)
+	assert.Nil(t, err)
+	defer held.Close()
+	w := held.Writer()
+	assert.Nil(t, held.SendQueuedPriority(held.Writer(), strict.LocalAddress(), 0))
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, held.Send(w, strict.LocalAddress(), 20*time.Millisecond))
+	assert.Nil(t, held.FlushQueue(20*time.Millisecond))
+	for i := 0; i < 2; i++ {
+		reader, _, _, err = strict.Receive(time.Second)
+		assert.Nil(t, err)
+		if assert.NotNil(t, reader) {
+			reader.Close()
+		}
+	}
+	assert.Len(t, reasons, 1)
+	//
+	// Each attempt of SendReliable has a new time, so a late receiver still
+	// accepts the latest.
+	//
+	reliable := &Protocol{Sequenced: true, Timestamped: true, ClockSkew: 50 * time.Millisecond, Payload: 64}
+	acker, err := NewEndpoint(reliable, 0, 8)
+	assert.Nil(t, err)
+	defer acker.Close()
+	retrier, err := NewEndpoint(reliable, 0, 8)
+	assert.Nil(t, err)
+	defer retrier.Close()
+	go func() {
+		time.Sleep(130 * time.Millisecond)
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			if reader, _, _, err := acker.ReceiveAndAck(time.Second); err != nil || reader != nil {
+				if reader != nil {
+					reader.Close()
+				}
+				return
+			}
+		}
+	}()
+	ackAddr, _ := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(acker.LocalPort()))
+	assert.Nil(t, retrier.SendReliable(retrier.Writer(), ackAddr, 60*time.Millisecond, 4))
+	assert.Panics(t, func() {
+		NewEndpoint(&Protocol{Timestamped: true, Payload: 64, Codec: &reversedCodec{}}, 0, 8)
+	})
+}
+
+func TestDecimal(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	type decimal struct {
+		mantissa int64
+		scale    int8
+	}
+	values := []decimal{
+		{12345, 2},  // 123.45
+		{-12345, 2}, // -123.45
+		{-1, 8},
+		{math.MaxInt64, -3},
+		{math.MinInt64, math.MaxInt8},
+	}
+	w := sender.Writer()
+	for _, v := range values {
+		assert.Nil(t, w.WriteDecimal(v.mantissa, v.scale))
+	}
+	assert.Equal(t, 256-9*len(values), w.Remaining())
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	for _, want := range values {
+		mantissa, scale, err := reader.ReadDecimal()
+		assert.Nil(t, err)
+		assert.Equal(t, want, decimal{mantissa, scale})
+	}
+	_, _, err = reader.ReadDecimal()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReceiveFilter(t *testing.T) {
+	protocol := &Protocol{HashString: "filter/v1", Payload: 64}
+	blocked, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer blocked.Close()
+	allowed, err := NewEndpoint(protocol, 0, 8)
+	assert.Nil(t, err)
+	defer allowed.Close()
+	var raw [][]byte
+	rejects := 0
+	receiver, err := NewEndpoint(protocol, 0, 8,
+		WithReceiveFilter(func(b []byte, addr *net.UDPAddr) bool {
+			raw = append(raw, append([]byte(nil), b...))
+			return addr.Port != blocked.LocalPort()
+		}),
+		WithOnReject(func(*net.UDPAddr, string) { rejects++ }),
+	)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()}
+	w := blocked.Writer()
+	w.WriteUint8(1)
+	assert.Nil(t, blocked.Send(w, to, 20*time.Millisecond))
+	reader, addr, _, err := receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, reader)
+	assert.Nil(t, addr)
+	assert.Equal(t, 0, receiver.OutstandingBuffers())
+	w = allowed.Writer()
+	w.WriteUint8(2)
+	assert.Nil(t, allowed.Send(w, to, 20*time.Millisecond))
+	reader, addr, _, err = receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reader) {
+		assert.Equal(t, allowed.LocalPort(), addr.Port)
+		v, _ := reader.ReadUint8()
+		assert.Equal(t, uint8(2), v)
+		reader.Close()
+	}
+	//
+	// The filter sees the raw bytes, including the header.
+	//
+	if assert.Len(t, raw, 2) {
+		assert.Equal(t, protocol.hash(), binary.BigEndian.Uint64(raw[0]))
+		assert.Equal(t, []byte{1}, raw[0][8:])
+	}
+	assert.Zero(t, rejects)
+}
+
+func TestStringSlice(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	tags := []string{"urgent", "", "café", "世界", "🌍 earth"}
+	w := sender.Writer()
+	assert.Nil(t, w.WriteStringSlice(nil))
+	assert.Nil(t, w.WriteStringSlice(tags))
+	//
+	// Nothing is written if the strings do not fit.
+	//
+	n := w.Len()
+	assert.ErrorIs(t, w.WriteStringSlice([]string{strings.Repeat("x", w.Remaining())}), ErrOverflow)
+	assert.Equal(t, n, w.Len())
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.Nil(t, err)
+	defer reader.Close()
+	ss, err := reader.ReadStringSlice()
+	assert.Nil(t, err)
+	assert.Empty(t, ss)
+	ss, err = reader.ReadStringSlice()
+	assert.Nil(t, err)
+	assert.Equal(t, tags, ss)
+	assert.Nil(t, reader.AssertEmpty())
+	//
+	// A count larger than the payload could hold is refused.
+	//
+	clone := &Reader{buffer: bytes.NewBuffer([]byte{0xff, 0xff, 0, 1, 'a'}), endpoint: receiver, clone: true}
+	_, err = clone.ReadStringSlice()
+	assert.ErrorIs(t, err, ErrOverflow)
+	//
+	// A length error after the first string consumes nothing.
+	//
+	bad := []byte{0, 2, 0, 1, 'a', 0, 5, 'b', 'c'}
+	clone = &Reader{buffer: bytes.NewBuffer(bad), endpoint: receiver, clone: true}
+	_, err = clone.ReadStringSlice()
+	assert.ErrorIs(t, err, ErrOverflow)
+	assert.Equal(t, bad, clone.buffer.Bytes())
+}
+
+func TestProtocolEqual(t *testing.T) {
+	codec := &reversedCodec{}
+	base := Protocol{
+		Hash:              1,
+		Sequenced:         true,
+		Payload:           512,
+		Codec:             codec,
+		PadTo:             256,
+		ChecksumAlgorithm: ChecksumCRC32C,
+		FrameLengthBytes:  2,
+		ClockSkew:         time.Second,
+	}
+	same := base
+	assert.True(t, base.Equal(&same))
+	assert.True(t, same.Equal(&base))
+	assert.False(t, base.Equal(nil))
+	assert.True(t, (*Protocol)(nil).Equal(nil))
+	changes := []func(p *Protocol){
+		func(p *Protocol) { p.Hash = 2 },
+		func(p *Protocol) { p.HashString = "other" },
+		func(p *Protocol) { p.Sequenced = false },
+		func(p *Protocol) { p.Payload = 513 },
+		func(p *Protocol) { p.Codec = &reversedCodec{} },
+		func(p *Protocol) { p.PadTo = 128 },
+		func(p *Protocol) { p.Checksum = true },
+		func(p *Protocol) { p.ChecksumHeaders = true },
+		func(p *Protocol) { p.ChecksumAlgorithm = ChecksumXXHash64 },
+		func(p *Protocol) { p.FrameLengthBytes = 4 },
+		func(p *Protocol) { p.RejectZeroSequence = true },
+		func(p *Protocol) { p.Timestamped = true },
+		func(p *Protocol) { p.ClockSkew = time.Minute },
+	}
+	//
+	// Every field must be covered, so that new fields are not forgotten.
+	//
+	assert.Equal(t, reflect.TypeOf(base).NumField(), len(changes))
+	for i, change := range changes {
+		other := base
+		change(&other)
+		assert.False(t, base.Equal(&other), "field %d", i)
+	}
+}
+
+func TestReceiveAddr(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()}
+	var addr net.UDPAddr
+	for i := 0; i < 2; i++ {
+		w := sender.Writer()
+		w.WriteUint8(uint8(i))
+		assert.Nil(t, sender.Send(w, to, 20*time.Millisecond))
+		reader, _, err := receiver.ReceiveAddr(&addr, time.Second)
+		assert.Nil(t, err)
+		if assert.NotNil(t, reader) {
+			v, _ := reader.ReadUint8()
+			assert.Equal(t, uint8(i), v)
+			reader.Close()
+		}
+		assert.Equal(t, sender.LocalPort(), addr.Port)
+		assert.True(t, addr.IP.Equal(net.IPv4(127, 0, 0, 1)))
+	}
+}
+
+func benchmarkReceiveAddr(b *testing.B, receive func(e *Endpoint) *Reader) {
+	receiver, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer receiver.Close()
+	sender, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer sender.Close()
+	body := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		sender.SendBytes(body, receiver.LocalAddress(), 0)
+		b.StartTimer()
+		if reader := receive(receiver); reader != nil {
+			reader.Close()
+		}
+	}
+}
+
+func BenchmarkReceiveUDPAddr(b *testing.B) {
+	benchmarkReceiveAddr(b, func(e *Endpoint) *Reader {
+		reader, _, _, _ := e.Receive(time.Second)
+		return reader
+	})
+}
+
+func BenchmarkReceiveAddr(b *testing.B) {
+	var addr net.UDPAddr
+	benchmarkReceiveAddr(b, func(e *Endpoint) *Reader {
+		reader, _, _ := e.ReceiveAddr(&addr, time.Second)
+		return reader
+	})
+}
+
+// testHandler captures slog records.
+type testHandler struct {
+	lock    sync.Mutex
+	records []slog.Record
+}
+
+func (h *testHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *testHandler) Handle(_ context.Context, r slog.Record) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *testHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *testHandler) WithGroup(string) slog.Handler { return h }
+
+// find returns the attributes of the first record with the message.
+func (h *testHandler) find(msg string) (level slog.Level, attrs map[string]string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, r := range h.records {
+		if r.Message != msg {
+			continue
+		}
+		attrs = make(map[string]string)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value.String()
+			return true
+		})
+		return r.Level, attrs
+	}
+	return
+}
+
+func TestLogger(t *testing.T) {
+	protocol := &Protocol{HashString: "log/v1", Sequenced: true, Payload: 64}
+	h := &testHandler{}
+	receiver, err := NewEndpoint(protocol, 0, 8, WithLogger(slog.New(h)))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(protocol, 0, 8, WithLogger(slog.New(h)))
+	assert.Nil(t, err)
+	defer sender.Close()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()}
+	w := sender.Writer()
+	w.WriteUint64(1)
+	assert.Nil(t, sender.Send(w, to, 20*time.Millisecond))
+	reader, _, _, err := receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	reader.Close()
+	level, attrs := h.find("send")
+	assert.Equal(t, slog.LevelDebug, level)
+	assert.Equal(t, sender.LocalAddress().String(), attrs[LogLocal])
+	assert.Equal(t, to.String(), attrs[LogRemote])
+	assert.Equal(t, "24", attrs[LogBytes])
+	assert.Equal(t, "1", attrs[LogSeq])
+	level, attrs = h.find("receive")
+	assert.Equal(t, slog.LevelDebug, level)
+	assert.Equal(t, receiver.LocalAddress().String(), attrs[LogLocal])
+	assert.Equal(t, "127.0.0.1:"+strconv.Itoa(sender.LocalPort()), attrs[LogRemote])
+	assert.Equal(t, "24", attrs[LogBytes])
+	assert.Equal(t, "1", attrs[LogSeq])
+	//
+	// A stranger is rejected with a warning.
+	//
+	stranger, err := NewEndpoint(&Protocol{HashString: "stranger", Payload: 64}, 0, 8)
+	assert.Nil(t, err)
+	defer stranger.Close()
+	assert.Nil(t, stranger.Send(stranger.Writer(), to, 20*time.Millisecond))
+	reader, _, _, err = receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, reader)
+	level, attrs = h.find("reject")
+	assert.Equal(t, slog.LevelWarn, level)
+	assert.Equal(t, RejectHash, attrs[LogReason])
+	assert.Equal(t, "127.0.0.1:"+strconv.Itoa(stranger.LocalPort()), attrs[LogRemote])
+	//
+	// Timeouts are not logged.
+	//
+	count := len(h.records)
+	_, _, _, err = receiver.Receive(time.Millisecond)
+	assert.True(t, IsTimeout(err))
+	assert.Equal(t, count, len(h.records))
+}
+
+func TestRecommendedPool(t *testing.T) {
+	assert.Equal(t, 1, RecommendedPool(-1))
+	assert.Equal(t, 1, RecommendedPool(0))
+	prev := 1
+	for _, c := range []int{1, 2, 8, 100} {
+		n := RecommendedPool(c)
+		assert.Greater(t, n, prev)
+		assert.GreaterOrEqual(t, n, 2*c) // A writer and a reader each.
+		prev = n
+	}
+	//
+	// A pool of the recommended size does not run out.
+	//
+	e, err := NewEndpoint(&testprotocol, 0, RecommendedPool(4))
+	assert.Nil(t, err)
+	defer e.Close()
+	e.Warm()
+	var writers []*Writer
+	for i := 0; i < 4; i++ {
+		writers = append(writers, e.Writer())
+		assert.Nil(t, e.Send(e.Writer(), e.LocalAddress(), 20*time.Millisecond))
+	}
+	var readers []*Reader
+	for i := 0; i < 4; i++ {
+		r, _, _, err := e.Receive(time.Second)
+		assert.Nil(t, err)
+		readers = append(readers, r)
+	}
+	assert.LessOrEqual(t, e.OutstandingBuffers(), RecommendedPool(4))
+	for i := range readers {
+		readers[i].Close()
+		e.discard(writers[i])
+	}
+	assert.Equal(t, 0, e.OutstandingBuffers())
+}
+
+func TestReadFrameNoCopy(t *testing.T) {
+	for _, width := range []int{1, 2, 4} {
+		protocol := &Protocol{Payload: 256, FrameLengthBytes: width}
+		e, err := NewEndpoint(protocol, 0, 8)
+		assert.Nil(t, err)
+		defer e.Close()
+		w := e.Writer()
+		assert.Nil(t, w.Write([]byte("first")))
+		assert.Nil(t, w.Write(nil))
+		assert.Nil(t, w.Write([]byte("second")))
+		assert.Nil(t, e.Send(w, e.LocalAddress(), 20*time.Millisecond))
+		reader, _, _, err := e.Receive(time.Second)
+		assert.Nil(t, err)
+		for _, want := range []string{"first", "", "second"} {
+			v, err := reader.ReadFrameNoCopy()
+			assert.Nil(t, err)
+			assert.Equal(t, want, string(v))
+		}
+		_, err = reader.ReadFrameNoCopy()
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		reader.Close()
+		_, err = reader.ReadFrameNoCopy()
+		assert.ErrorIs(t, err, ErrClosedReader)
+	}
+	//
+	// The slice aliases the payload.
+	//
+	e, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer e.Close()
+	frame := []byte{0, 3, 'a', 'b', 'c'}
+	reader := &Reader{buffer: bytes.NewBuffer(frame), endpoint: e, clone: true}
+	v, err := reader.ReadFrameNoCopy()
+	assert.Nil(t, err)
+	assert.Equal(t, &frame[2], &v[0])
+}
+
+func BenchmarkReadFrameNoCopy(b *testing.B) {
+	e, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer e.Close()
+	frame := append([]byte{0, 64}, make([]byte, 64)...)
+	reader := &Reader{
+		buffer:   new(bytes.Buffer),
+		endpoint: e,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader.buffer.Reset()
+		reader.buffer.Write(frame)
+		reader.ReadFrameNoCopy()
+	}
+}
+
+func TestNegativePort(t *testing.T) {
+	var (
+		e   *Endpoint
+		err error
+	)
+	assert.NotPanics(t, func() {
+		e, err = NewEndpoint(&testprotocol, -1, 8)
+	})
+	assert.ErrorIs(t, err, ErrInvalidPort)
+	assert.Nil(t, e)
+}
+
+func TestSharedPool(t *testing.T) {
+	pool := NewSharedPool(testprotocol.Payload, 8)
+	var endpoints []*Endpoint
+	for i := 0; i < 3; i++ {
+		e, err := NewEndpointShared(&testprotocol, 0, pool)
+		assert.Nil(t, err)
+		defer e.Close()
+		endpoints = append(endpoints, e)
+	}
+	for i, e := range endpoints {
+		to := endpoints[(i+1)%len(endpoints)]
+		w := e.Writer()
+		w.WriteUint16(uint16(i))
+		assert.Nil(t, e.Send(w, to.LocalAddress(), 20*time.Millisecond))
+	}
+	var readers []*Reader
+	for i, e := range endpoints {
+		r, _, _, err := e.Receive(time.Second)
+		assert.Nil(t, err)
+		assert.NotNil(t, r)
+		v, _ := r.ReadUint16()
+		assert.Equal(t, uint16((i+len(endpoints)-1)%len(endpoints)), v)
+		readers = append(readers, r)
+	}
+	for _, e := range endpoints {
+		assert.Equal(t, len(endpoints), e.OutstandingBuffers())
+	}
+	for _, r := range readers {
+		r.Close()
+	}
+	assert.Equal(t, 0, endpoints[0].OutstandingBuffers())
+
+	larger := testprotocol
+	larger.Payload++
+	assert.Panics(t, func() { NewEndpointShared(&larger, 0, pool) })
+}
+
+func TestPeekFrameLen(t *testing.T) {
+	for _, width := range []int{1, 2, 4} {
+		protocol := &Protocol{Payload: 256, FrameLengthBytes: width}
+		e, err := NewEndpoint(protocol, 0, 8)
+		assert.Nil(t, err)
+		defer e.Close()
+		w := e.Writer()
+		assert.Nil(t, w.Write([]byte("first")))
+		assert.Nil(t, w.Write([]byte("second")))
+		assert.Nil(t, e.Send(w, e.LocalAddress(), 20*time.Millisecond))
+		reader, _, _, err := e.Receive(time.Second)
+		assert.Nil(t, err)
+		for _, want := range []string{"first", "second"} {
+			n, err := reader.PeekFrameLen()
+			assert.Nil(t, err)
+			assert.Equal(t, len(want), n)
+			n, err = reader.PeekFrameLen()
+			assert.Nil(t, err)
+			assert.Equal(t, len(want), n)
+			v, err := reader.Read()
+			assert.Nil(t, err)
+			assert.Equal(t, n, len(v))
+			assert.Equal(t, want, string(v))
+		}
+		assert.Equal(t, 2, reader.FieldsRead())
+		_, err = reader.PeekFrameLen()
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		reader.Close()
+		_, err = reader.PeekFrameLen()
+		assert.ErrorIs(t, err, ErrClosedReader)
+	}
+	//
+	// A length past the end of the payload.
+	//
+	e, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer e.Close()
+	w := e.Writer()
+	assert.Nil(t, w.WriteUint16(10))
+	assert.Nil(t, e.Send(w, e.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err := e.Receive(time.Second)
+	assert.Nil(t, err)
+	defer reader.Close()
+	_, err = reader.PeekFrameLen()
+	assert.ErrorIs(t, err, ErrOverflow)
+}
+
+func TestCapture(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8, WithCaptureBatch(4))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	var sent [][]byte
+	for i := 0; i < 6; i++ {
+		w := sender.Writer()
+		w.WriteUint64(uint64(i))
+		sent = append(sent, append([]byte(nil), w.buffer.Bytes()...))
+		assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	var received int
+	for received < len(sent) {
+		batch, err := receiver.Capture(time.Second)
+		assert.Nil(t, err)
+		assert.Positive(t, batch.Len())
+		assert.LessOrEqual(t, batch.Len(), 4)
+		for i := 0; i < batch.Len(); i++ {
+			assert.Equal(t, sent[received], batch.Datagram(i))
+			assert.Equal(t, uint16(sender.LocalPort()), batch.Addr(i).Port())
+			assert.True(t, batch.Addr(i).Addr().IsValid())
+			received++
+		}
+		assert.Nil(t, batch.Release())
+		assert.ErrorIs(t, batch.Release(), ErrReleasedBatch)
+	}
+	_, err = receiver.Capture(20 * time.Millisecond)
+	assert.True(t, IsTimeout(err))
+	//
+	// Only one of several concurrent releases recycles the batch.
+	//
+	w := sender.Writer()
+	w.WriteUint64(6)
+	assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	batch, err := receiver.Capture(time.Second)
+	if assert.Nil(t, err) {
+		var wg sync.WaitGroup
+		var released atomic.Int32
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if batch.Release() == nil {
+					released.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), released.Load())
+	}
+	assert.Panics(t, func() { NewEndpoint(&testprotocol, 0, 8, WithCaptureBatch(0)) })
+}
+
+func TestCaptureLazy(t *testing.T) {
+	//
+	// Making an end point does not make any capture arenas.
+	//
+	protocol := &Protocol{Payload: MaxPayload}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	e, err := NewEndpoint(protocol, 0, 8)
+	runtime.ReadMemStats(&after)
+	assert.Nil(t, err)
+	defer e.Close()
+	assert.Nil(t, e.batches)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(DefaultCaptureBatch*int(MaxPayload)))
+	//
+	// Until Capture is called.
+	//
+	_, err = e.Capture(time.Millisecond)
+	assert.True(t, IsTimeout(err))
+	assert.NotNil(t, e.batches)
+}
+
+func TestReassemblePooledRead(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8, WithPooledRead())
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// A frame larger than the payload, then one that fits the pooled slices.
+	//
+	large := bytes.Repeat([]byte{'x'}, 300)
+	message := binary.BigEndian.AppendUint16(nil, uint16(len(large)))
+	message = append(message, large...)
+	message = append(message, 0, 3, 'a', 'b', 'c')
+	for _, fragment := range [][]byte{message[:200], message[200:]} {
+		assert.Nil(t, sender.SendBytes(fragment, receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	var fragments []*Reader
+	for i := 0; i < 2; i++ {
+		reader, _, _, err := receiver.Receive(time.Second)
+		assert.Nil(t, err)
+		fragments = append(fragments, reader)
+	}
+	reader, err := receiver.Reassemble(fragments)
+	assert.Nil(t, err)
+	defer reader.Close()
+	v, err := reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, large, v)
+	receiver.Release(v)
+	v, err = reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", string(v))
+	assert.Equal(t, receiver.payload, cap(v))
+	receiver.Release(v)
+}
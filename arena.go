@@ -0,0 +1,27 @@
+package datagram
+
+import (
+	"sync"
+)
+
+// An arena hands out payload sized slices carved from larger slabs, so that
+// many payload buffers are made with one allocation. A slab is freed once all
+// the buffers made from it have been discarded.
+type arena struct {
+	lock  sync.Mutex
+	size  int    // The size of each slice.
+	count int    // The number of slices in each slab.
+	slab  []byte // The unused part of the current slab.
+}
+
+// next returns an empty slice with a capacity of the arena size.
+func (a *arena) next() []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.slab) < a.size {
+		a.slab = make([]byte, a.size*a.count)
+	}
+	b := a.slab[:0:a.size]
+	a.slab = a.slab[a.size:]
+	return b
+}
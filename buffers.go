@@ -0,0 +1,84 @@
+package datagram
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/gbkr-com/app"
+)
+
+// A bufferPool is the pool of payload buffers, counting those fetched but not
+// yet recycled for OutstandingBuffers.
+type bufferPool struct {
+	*app.Pool[*bytes.Buffer]
+	outstanding atomic.Int64
+}
+
+// newBufferPool returns a pool of buffers that start with the capacity given,
+// or that are carved from an arena of payload sized slices if the arena count
+// is not zero.
+func newBufferPool(size, capacity, payload, count int) *bufferPool {
+	factory := func() *bytes.Buffer {
+		buffer := new(bytes.Buffer)
+		buffer.Grow(capacity)
+		return buffer
+	}
+	if count > 0 {
+		a := &arena{size: payload, count: count}
+		factory = func() *bytes.Buffer {
+			return bytes.NewBuffer(a.next())
+		}
+	}
+	return &bufferPool{Pool: app.NewPool(
+		size,
+		app.WithPoolFactory(factory),
+		app.WithPoolReset(
+			func(b *bytes.Buffer) {
+				b.Reset()
+			},
+		),
+		app.WithPoolDiscard[*bytes.Buffer](),
+	)}
+}
+
+// newWriterPool returns a pool of writers.
+func newWriterPool(size int) *app.Pool[*Writer] {
+	return app.NewPool(
+		size,
+		app.WithPoolFactory(func() *Writer { return &Writer{} }),
+		app.WithPoolReset(func(w *Writer) { w.buffer = nil }),
+		app.WithPoolDiscard[*Writer](),
+	)
+}
+
+// Next returns the next free buffer from the pool.
+func (p *bufferPool) Next() *bytes.Buffer {
+	p.outstanding.Add(1)
+	return p.Pool.Next()
+}
+
+// Recycle returns the buffer to the pool.
+func (p *bufferPool) Recycle(b *bytes.Buffer) {
+	p.outstanding.Add(-1)
+	p.Pool.Recycle(b)
+}
+
+// OutstandingBuffers returns the number of payload buffers taken from the pool
+// and not yet returned, which is useful for detecting leaks such as readers
+// that are never closed. A writer holds a buffer until it is sent, or for
+// good if the send fails.
+func (e *Endpoint) OutstandingBuffers() int {
+	return int(e.buffers.outstanding.Load())
+}
+
+// RecommendedPool returns a minimum pool size for NewEndpoint when up to the
+// given number of goroutines each hold a writer and a reader at the same time,
+// since both draw from the buffer pool, with one more for the Receive waiting on
+// the socket. A smaller pool still works, but allocates buffers when it runs
+// out.
+func RecommendedPool(concurrency int) int {
+	if concurrency < 1 {
+		return 1
+	}
+	return 2*concurrency + 1
+}
@@ -0,0 +1,101 @@
+package datagram
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/gbkr-com/app"
+)
+
+// DefaultCaptureBatch is the most datagrams a CaptureBatch holds unless the
+// WithCaptureBatch option is given.
+const DefaultCaptureBatch = 32
+
+// A CaptureBatch holds the raw UDP datagrams read by one call to Capture. The
+// datagrams are slices of an arena of payload sized slots that is kept with
+// the batch and reused, so that capturing does not copy or allocate per
+// datagram. The slices are only valid until the batch is released.
+type CaptureBatch struct {
+	endpoint  *Endpoint
+	arena     []byte
+	datagrams [][]byte
+	addrs     []netip.AddrPort
+	released  atomic.Bool
+	sys       captureSys // Platform state for reading the batch.
+}
+
+// newCaptureBatch returns a batch with an arena for the end point.
+func newCaptureBatch(e *Endpoint) *CaptureBatch {
+	b := &CaptureBatch{
+		endpoint:  e,
+		arena:     make([]byte, e.capture*e.payload),
+		datagrams: make([][]byte, 0, e.capture),
+		addrs:     make([]netip.AddrPort, 0, e.capture),
+	}
+	b.sys.init(b, e.capture, e.payload)
+	return b
+}
+
+// Len returns the number of datagrams in the batch.
+func (b *CaptureBatch) Len() int {
+	return len(b.datagrams)
+}
+
+// Datagram returns the i'th datagram in the batch, which must not be retained
+// after the batch is released.
+func (b *CaptureBatch) Datagram(i int) []byte {
+	return b.datagrams[i]
+}
+
+// Addr returns the source address of the i'th datagram in the batch.
+func (b *CaptureBatch) Addr(i int) netip.AddrPort {
+	return b.addrs[i]
+}
+
+// Release returns the batch and its arena to the end point for reuse. The
+// batch must not be used after this. Only the first of several calls, even on
+// different goroutines, releases the batch.
+func (b *CaptureBatch) Release() error {
+	if !b.released.CompareAndSwap(false, true) {
+		return ErrReleasedBatch
+	}
+	b.datagrams = b.datagrams[:0]
+	b.addrs = b.addrs[:0]
+	b.endpoint.batches.Recycle(b)
+	return nil
+}
+
+// Capture waits up to the timeout for incoming UDP datagrams and returns those
+// waiting, up to the WithCaptureBatch size, as raw bytes for packet capture.
+// The datagrams are not checked or consumed in any way: the protocol header,
+// FEC, filter, checksum and peer tracking are all passed by. Datagrams larger
+// than the payload are truncated. Each batch should be released once it is
+// no longer needed. The first call to Capture makes the pool of batches, as
+// many as the pool capacity given to NewEndpoint, each with an arena of
+// WithCaptureBatch payloads: 256 batches of 32 datagrams of 2048 bytes is
+// 16 MB. On Linux the batch is read with a single recvmmsg system
+// call, elsewhere each batch holds one datagram.
+func (e *Endpoint) Capture(timeout time.Duration) (batch *CaptureBatch, err error) {
+	if e.sendOnly {
+		err = ErrSendOnly
+		return
+	}
+	if err = e.readDeadline(timeout); err != nil {
+		return
+	}
+	e.batchesOnce.Do(func() {
+		e.batches = app.NewPool(
+			e.pool,
+			app.WithPoolFactory(func() *CaptureBatch { return newCaptureBatch(e) }),
+			app.WithPoolDiscard[*CaptureBatch](),
+		)
+	})
+	batch = e.batches.Next()
+	batch.released.Store(false)
+	if err = e.captureBatch(batch); err != nil {
+		batch.Release()
+		batch, err = nil, e.readError(err)
+	}
+	return
+}
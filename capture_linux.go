@@ -0,0 +1,95 @@
+package datagram
+
+import (
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is struct mmsghdr from sys/socket.h, for recvmmsg.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// captureSys holds the message headers that point recvmmsg at the arena slots.
+type captureSys struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+}
+
+func (s *captureSys) init(b *CaptureBatch, size, payload int) {
+	s.hdrs = make([]mmsghdr, size)
+	s.iovs = make([]syscall.Iovec, size)
+	s.names = make([]syscall.RawSockaddrAny, size)
+	for i := range s.hdrs {
+		s.iovs[i].Base = &b.arena[i*payload]
+		s.iovs[i].SetLen(payload)
+		s.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&s.names[i]))
+		s.hdrs[i].hdr.Iov = &s.iovs[i]
+		s.hdrs[i].hdr.Iovlen = 1
+	}
+}
+
+// captureBatch reads the datagrams waiting, blocking until there is at least
+// one or the read deadline passes.
+func (e *Endpoint) captureBatch(b *CaptureBatch) error {
+	rc, err := e.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	s := &b.sys
+	var n int
+	var errno syscall.Errno
+	err = rc.Read(func(fd uintptr) bool {
+		for {
+			for i := range s.hdrs {
+				s.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+				s.hdrs[i].hdr.Flags = 0
+			}
+			r, _, en := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&s.hdrs[0])), uintptr(len(s.hdrs)), syscall.MSG_DONTWAIT, 0, 0)
+			switch en {
+			case syscall.EINTR:
+				continue
+			case syscall.EAGAIN:
+				return false // Wait for the socket to be readable.
+			}
+			n, errno = int(r), en
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	payload := e.payload
+	for i := 0; i < n; i++ {
+		start := i * payload
+		b.datagrams = append(b.datagrams, b.arena[start:start+int(s.hdrs[i].len)])
+		b.addrs = append(b.addrs, sockaddrAddrPort(&s.names[i]))
+	}
+	return nil
+}
+
+// sockaddrAddrPort returns the address in the raw socket address, with any
+// IPv4 mapped address unmapped.
+func sockaddrAddrPort(sa *syscall.RawSockaddrAny) netip.AddrPort {
+	switch sa.Addr.Family {
+	case syscall.AF_INET:
+		p := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		return netip.AddrPortFrom(netip.AddrFrom4(p.Addr), networkPort(p.Port))
+	case syscall.AF_INET6:
+		p := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+		return netip.AddrPortFrom(netip.AddrFrom16(p.Addr).Unmap(), networkPort(p.Port))
+	}
+	return netip.AddrPort{}
+}
+
+// networkPort returns the port held in network byte order.
+func networkPort(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
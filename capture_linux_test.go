@@ -0,0 +1,81 @@
+package datagram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureBatch(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8, WithCaptureBatch(8))
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	for i := 0; i < 8; i++ {
+		assert.Nil(t, sender.SendBytes(make([]byte, i), receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	//
+	// One system call reads everything waiting.
+	//
+	batch, err := receiver.Capture(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, batch.Len())
+	for i := 0; i < batch.Len(); i++ {
+		assert.Equal(t, receiver.HeaderSize()+i, len(batch.Datagram(i)))
+	}
+	assert.Nil(t, batch.Release())
+}
+
+const benchmarkCaptureBurst = 32
+
+func BenchmarkCapture(b *testing.B) {
+	receiver, _ := NewEndpoint(&testprotocol, 0, 8, WithCaptureBatch(benchmarkCaptureBurst))
+	defer receiver.Close()
+	sender, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer sender.Close()
+	body := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < benchmarkCaptureBurst; j++ {
+			sender.SendBytes(body, receiver.LocalAddress(), 0)
+		}
+		b.StartTimer()
+		for n := 0; n < benchmarkCaptureBurst; {
+			batch, err := receiver.Capture(time.Second)
+			if err != nil {
+				b.Fatal(err)
+			}
+			n += batch.Len()
+			batch.Release()
+		}
+	}
+}
+
+func BenchmarkCaptureReceive(b *testing.B) {
+	receiver, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer receiver.Close()
+	sender, _ := NewEndpoint(&testprotocol, 0, 8)
+	defer sender.Close()
+	body := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < benchmarkCaptureBurst; j++ {
+			sender.SendBytes(body, receiver.LocalAddress(), 0)
+		}
+		b.StartTimer()
+		for n := 0; n < benchmarkCaptureBurst; n++ {
+			reader, _, _, err := receiver.Receive(time.Second)
+			if err != nil {
+				b.Fatal(err)
+			}
+			reader.Close()
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package datagram
+
+import (
+	"net/netip"
+)
+
+// captureSys is empty as each batch is read one datagram at a time.
+type captureSys struct{}
+
+func (s *captureSys) init(b *CaptureBatch, size, payload int) {}
+
+// captureBatch reads one datagram into the first slot of the arena.
+func (e *Endpoint) captureBatch(b *CaptureBatch) error {
+	n, ap, err := e.conn.ReadFromUDPAddrPort(b.arena[:e.payload])
+	if err != nil {
+		return err
+	}
+	b.datagrams = append(b.datagrams, b.arena[:n])
+	b.addrs = append(b.addrs, netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()))
+	return nil
+}
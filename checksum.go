@@ -0,0 +1,80 @@
+package datagram
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// A ChecksumAlgorithm selects how the checksum of a Protocol is calculated.
+type ChecksumAlgorithm uint8
+
+// Checksum algorithms. The default is CRC32C, which takes four bytes. XXHash64
+// takes eight bytes and is faster on platforms without hardware support for
+// CRC32C. Compare with BenchmarkChecksumCRC32C and BenchmarkChecksumXXHash64.
+const (
+	ChecksumCRC32C ChecksumAlgorithm = iota
+	ChecksumXXHash64
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksummed returns true if the protocol has a checksum trailer.
+func (p *Protocol) checksummed() bool {
+	return p.Checksum || p.ChecksumHeaders
+}
+
+// checksumSize returns the number of bytes in the checksum trailer.
+func (p *Protocol) checksumSize() int {
+	if p.ChecksumAlgorithm == ChecksumXXHash64 {
+		return 8
+	}
+	return 4
+}
+
+// checksumStart returns the offset of the first byte covered by the checksum.
+func (p *Protocol) checksumStart() int {
+	if p.ChecksumHeaders {
+		return 0
+	}
+	return p.headerSize()
+}
+
+// checksum writes the checksum of the bytes into sum, which must be
+// checksumSize bytes long.
+func (p *Protocol) checksum(b, sum []byte) {
+	if p.ChecksumAlgorithm == ChecksumXXHash64 {
+		binary.BigEndian.PutUint64(sum, xxhash.Sum64(b))
+		return
+	}
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(b, castagnoli))
+}
+
+// checksumWrite appends the checksum of the payload in the writer.
+func checksumWrite(endpoint *Endpoint, writer *Writer) {
+	p := endpoint.protocol
+	var sum [8]byte
+	p.checksum(writer.buffer.Bytes()[p.checksumStart():], sum[:p.checksumSize()])
+	writer.buffer.Write(sum[:p.checksumSize()])
+}
+
+// checksumRead returns false if the checksum at the end of the received payload
+// does not match, otherwise it removes the checksum from the buffer.
+func checksumRead(endpoint *Endpoint, buffer *bytes.Buffer) bool {
+	p := endpoint.protocol
+	b := buffer.Bytes()
+	start := p.checksumStart()
+	end := len(b) - p.checksumSize()
+	if end < start {
+		return false
+	}
+	var sum [8]byte
+	p.checksum(b[start:end], sum[:p.checksumSize()])
+	if !bytes.Equal(sum[:p.checksumSize()], b[end:]) {
+		return false
+	}
+	buffer.Truncate(end)
+	return true
+}
@@ -6,3 +6,8 @@ import (
 
 // MaxPayload is the maximum data size for regular UDP datagrams.
 const MaxPayload uint16 = math.MaxUint16 - 8 /* UDP */ - 20 /* IPv4 */
+
+// MaxOversizePayload is the maximum data size for UDP datagrams where the IP
+// header does not count against the 16 bit length, which is the case for IPv6.
+// See WithAllowOversize.
+const MaxOversizePayload uint16 = math.MaxUint16 - 8 /* UDP */
@@ -0,0 +1,16 @@
+package datagram
+
+// Cork holds back the payloads sent from this end point, which the kernel
+// appends to one another, until Uncork sends them as a single datagram. This
+// batches many small payloads to one destination into one, so the receiver
+// must be able to tell where each ends, and the total must fit the payload.
+// This is only supported on Linux, with the UDP_CORK socket option, elsewhere
+// ErrNotSupported is returned.
+func (e *Endpoint) Cork() error {
+	return setCork(e.conn, true)
+}
+
+// Uncork sends the payloads held back since Cork as one datagram.
+func (e *Endpoint) Uncork() error {
+	return setCork(e.conn, false)
+}
@@ -0,0 +1,27 @@
+package datagram
+
+import (
+	"net"
+	"syscall"
+)
+
+const udpCork = 1 // UDP_CORK from linux/udp.h.
+
+func setCork(conn *net.UDPConn, on bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	v := 0
+	if on {
+		v = 1
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpCork, v)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,46 @@
+package datagram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCork(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	assert.Nil(t, sender.Cork())
+	for _, s := range []string{"one", "two", "three"} {
+		assert.Nil(t, sender.SendBytes([]byte(s), receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	//
+	// Nothing is sent until the socket is uncorked.
+	//
+	reader, _, _, err := receiver.Receive(20 * time.Millisecond)
+	assert.True(t, IsTimeout(err))
+	assert.Nil(t, reader)
+	assert.Nil(t, sender.Uncork())
+	reader, _, _, err = receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reader) {
+		b, _ := reader.ReadAll()
+		assert.Equal(t, "onetwothree", string(b))
+		reader.Close()
+	}
+	//
+	// Once uncorked, each payload is a datagram again.
+	//
+	assert.Nil(t, sender.SendBytes([]byte("four"), receiver.LocalAddress(), 20*time.Millisecond))
+	reader, _, _, err = receiver.Receive(time.Second)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reader) {
+		b, _ := reader.ReadAll()
+		assert.Equal(t, "four", string(b))
+		reader.Close()
+	}
+}
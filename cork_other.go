@@ -0,0 +1,11 @@
+//go:build !linux
+
+package datagram
+
+import (
+	"net"
+)
+
+func setCork(conn *net.UDPConn, on bool) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,153 @@
+package datagram
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/gbkr-com/app"
+)
+
+// datagramsBackoff is the longest wait between retries of the receive loop of
+// Datagrams after an error.
+const datagramsBackoff = time.Second
+
+// A ReceivedDatagram is a UDP payload delivered by Datagrams. The consumer is
+// responsible for closing the reader.
+type ReceivedDatagram struct {
+	Reader *Reader
+	Addr   *net.UDPAddr
+	Seq    uint64
+}
+
+// Datagrams runs a receive loop and delivers each received payload on the
+// returned channel. The channel is closed when the context is cancelled, the
+// end point is closed or shut down, or at once if the end point is WithSendOnly.
+// Datagrams rejected by the protocol are not delivered. Other errors from
+// Receive are retried, waiting twice as long after each one in a row, up to a
+// second, so that a persistent error does not spin the loop.
+//
+// The receive loop uses the read deadline of the end point, so Receive should
+// not be called at the same time.
+func (e *Endpoint) Datagrams(ctx context.Context) <-chan ReceivedDatagram {
+	ch := make(chan ReceivedDatagram)
+	go func() {
+		defer close(ch)
+		//
+		// Clear any deadline left by an earlier Receive, then unblock the
+		// loop by setting an immediate deadline when the context is done.
+		//
+		if err := e.conn.SetReadDeadline(time.Time{}); err != nil {
+			return
+		}
+		finished := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				e.conn.SetReadDeadline(time.Now())
+			case <-finished:
+			}
+		}()
+		//
+		// Once the watcher has stopped, clear any deadline it set so that
+		// later receives are not affected, unless the deadline is that of
+		// Shutdown.
+		//
+		defer func() {
+			close(finished)
+			<-stopped
+			if !e.shutdown.Load() {
+				e.conn.SetReadDeadline(time.Time{})
+			}
+		}()
+		var backoff time.Duration
+		for {
+			if app.IsDone(ctx) {
+				return
+			}
+			reader, addr, seq, err := e.Receive(0)
+			if err != nil {
+				if app.IsDone(ctx) || IsClosed(err) || err == ErrSendOnly || err == ErrShutdown {
+					return
+				}
+				//
+				// The first error is retried at once, in case it was only
+				// that of one datagram.
+				//
+				if backoff > 0 {
+					timer := time.NewTimer(backoff)
+					select {
+					case <-timer.C:
+					case <-ctx.Done():
+						timer.Stop()
+						return
+					}
+				}
+				backoff = min(max(2*backoff, time.Millisecond), datagramsBackoff)
+				continue
+			}
+			backoff = 0
+			if reader == nil {
+				continue
+			}
+			select {
+			case ch <- ReceivedDatagram{Reader: reader, Addr: addr, Seq: seq}:
+			case <-ctx.Done():
+				reader.Close()
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// A ReceiveResult is the outcome of ReceiveChan, which is the same as the
+// values returned by Receive.
+type ReceiveResult struct {
+	Reader *Reader
+	Addr   *net.UDPAddr
+	Seq    uint64
+	Err    error
+}
+
+// ReceiveChan calls Receive in a goroutine and returns a channel that delivers
+// the single result and is then closed, for use in a select statement. The
+// channel is buffered so the goroutine finishes even if the result is never
+// taken, though in that case the reader is never closed.
+func (e *Endpoint) ReceiveChan(timeout time.Duration) <-chan ReceiveResult {
+	ch := make(chan ReceiveResult, 1)
+	go func() {
+		var r ReceiveResult
+		r.Reader, r.Addr, r.Seq, r.Err = e.Receive(timeout)
+		ch <- r
+		close(ch)
+	}()
+	return ch
+}
+
+// Echo runs a receive loop that sends the body of each received payload back to
+// its source, until the context is cancelled or the end point is closed or shut
+// down. The error is that of the context, net.ErrClosed, ErrShutdown or
+// ErrSendOnly. Failed sends are otherwise ignored. As with Datagrams, Receive
+// should not be called at the same time.
+func (e *Endpoint) Echo(ctx context.Context) error {
+	if e.sendOnly {
+		return ErrSendOnly
+	}
+	for d := range e.Datagrams(ctx) {
+		err := e.SendBytes(d.Reader.buffer.Bytes(), d.Addr, 0)
+		d.Reader.Close()
+		if IsClosed(err) {
+			return net.ErrClosed
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if e.shutdown.Load() {
+		return ErrShutdown
+	}
+	return net.ErrClosed
+}
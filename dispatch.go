@@ -0,0 +1,70 @@
+package datagram
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// RegisterVersionHandler registers the function to decode payloads whose body
+// starts with the given version byte, see ReceiveDispatch. Handlers should be
+// registered before ReceiveDispatch is first called.
+func (e *Endpoint) RegisterVersionHandler(version uint8, fn func(*Reader) error) {
+	if e.handlers == nil {
+		e.handlers = make(map[uint8]func(*Reader) error)
+	}
+	e.handlers[version] = fn
+}
+
+// ReceiveDispatch receives a UDP payload, reads the version byte at the start of
+// the body and calls the handler registered for that version. The reader is
+// closed when the handler returns. ErrUnsupportedVersion is returned if there is
+// no handler for the version. As with Receive, the address is nil and there is
+// no error when the incoming datagram does not match the protocol.
+func (e *Endpoint) ReceiveDispatch(timeout time.Duration) (addr *net.UDPAddr, seq uint64, err error) {
+	var reader *Reader
+	if reader, addr, seq, err = e.Receive(timeout); err != nil || reader == nil {
+		return
+	}
+	defer reader.Close()
+	var version uint8
+	if version, err = reader.ReadUint8(); err != nil {
+		return
+	}
+	fn, ok := e.handlers[version]
+	if !ok {
+		err = ErrUnsupportedVersion
+		return
+	}
+	err = fn(reader)
+	return
+}
+
+// ReceiveType receives UDP payloads until one arrives whose body starts with the
+// given message type byte, or the timeout expires. Payloads of other types, or
+// with an empty body, are discarded. The type byte is not consumed, so the
+// reader is positioned at the start of the body. The returned reader must be
+// closed after use.
+func (e *Endpoint) ReceiveType(msgType byte, timeout time.Duration) (reader *Reader, addr *net.UDPAddr, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var wait time.Duration
+		if timeout > 0 {
+			if wait = time.Until(deadline); wait <= 0 {
+				err = e.opError(OpReceive, os.ErrDeadlineExceeded)
+				return
+			}
+		}
+		if reader, addr, _, err = e.Receive(wait); err != nil {
+			return
+		}
+		if reader == nil {
+			continue
+		}
+		if body := reader.buffer.Bytes(); len(body) > 0 && body[0] == msgType {
+			return
+		}
+		reader.Close()
+		addr = nil
+	}
+}
@@ -0,0 +1,34 @@
+package datagram
+
+import (
+	"net"
+	"time"
+)
+
+// ReceiveECN is the same as Receive but also returns the ECN codepoint from the
+// IP header of the received datagram. This requires the WithECN option. On
+// platforms where the codepoint is not available it is always zero.
+func (e *Endpoint) ReceiveECN(timeout time.Duration) (reader *Reader, addr *net.UDPAddr, seq uint64, ecn uint8, err error) {
+	if e.sendOnly {
+		err = ErrSendOnly
+		return
+	}
+	if err = e.readDeadline(timeout); err != nil {
+		return
+	}
+	buffer := e.buffers.Next()
+	buffer.Write(e.zero)
+	oob := make([]byte, 64)
+	var n, oobn int
+	if n, oobn, _, addr, err = e.conn.ReadMsgUDP(buffer.Bytes(), oob); err != nil {
+		e.buffers.Recycle(buffer)
+		err = e.readError(err)
+		return
+	}
+	if reader, seq, _, err = e.accept(buffer, n, addr, nil); reader == nil {
+		addr = nil
+		return
+	}
+	ecn = parseECN(oob[:oobn])
+	return
+}
@@ -0,0 +1,45 @@
+package datagram
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+func enableECN(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		//
+		// The socket may be IPv4 only, or dual stack, so try both levels.
+		//
+		err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+		err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1)
+		if err4 != nil && err6 != nil {
+			serr = err4
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func parseECN(oob []byte) uint8 {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TOS && len(m.Data) >= 1:
+			return m.Data[0] & 0x03
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_TCLASS && len(m.Data) >= 4:
+			return uint8(*(*int32)(unsafe.Pointer(&m.Data[0]))) & 0x03
+		}
+	}
+	return 0
+}
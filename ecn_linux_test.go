@@ -0,0 +1,42 @@
+package datagram
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiveECN(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8, WithECN())
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// Mark the outgoing datagrams as ECT(0).
+	//
+	rc, err := sender.conn.SyscallConn()
+	assert.Nil(t, err)
+	rc.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, 0x02)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, 0x02)
+	})
+	for _, host := range []string{"127.0.0.1", "[::1]"} {
+		addr, _ := net.ResolveUDPAddr("udp", host+":"+strconv.Itoa(receiver.LocalPort()))
+		w := sender.Writer()
+		w.WriteInt64(1)
+		err = sender.Send(w, addr, 20*time.Millisecond)
+		assert.Nil(t, err)
+		reader, _, _, ecn, err := receiver.ReceiveECN(20 * time.Millisecond)
+		assert.Nil(t, err)
+		if assert.NotNil(t, reader) {
+			reader.Close()
+		}
+		assert.Equal(t, uint8(0x02), ecn, host)
+	}
+}
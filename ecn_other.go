@@ -0,0 +1,15 @@
+//go:build !linux
+
+package datagram
+
+import (
+	"net"
+)
+
+func enableECN(conn *net.UDPConn) error {
+	return nil
+}
+
+func parseECN(oob []byte) uint8 {
+	return 0
+}
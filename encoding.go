@@ -0,0 +1,68 @@
+package datagram
+
+import (
+	"math"
+)
+
+// An Encodable writes itself to a payload, see Writer.Encode.
+type Encodable interface {
+	EncodeTo(w *Writer) error
+}
+
+// A Decodable reads itself from a payload, see Reader.Decode.
+type Decodable interface {
+	DecodeFrom(r *Reader) error
+}
+
+// Encode writes the value by calling its EncodeTo method. If that returns an
+// error then anything it wrote is discarded.
+func (w *Writer) Encode(v Encodable) error {
+	mark := w.Save()
+	if err := v.EncodeTo(w); err != nil {
+		w.Restore(mark)
+		return err
+	}
+	return nil
+}
+
+// Decode reads the value by calling its DecodeFrom method.
+func (r *Reader) Decode(v Decodable) error {
+	return v.DecodeFrom(r)
+}
+
+// WriteList writes a list of n elements as a uint16 count followed by each
+// element, written by calling the function with its index. If the function
+// returns an error then the whole list is discarded and the error returned.
+func (w *Writer) WriteList(n int, fn func(w *Writer, i int) error) error {
+	if n < 0 || n > math.MaxUint16 {
+		return ErrInvalidLength
+	}
+	mark := w.Save()
+	if err := w.WriteUint16(uint16(n)); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := fn(w, i); err != nil {
+			w.Restore(mark)
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadList reads a list written by WriteList, calling the function to read each
+// element with its index, and returns the count. Reading stops at the first
+// error, which is returned with the count.
+func (r *Reader) ReadList(fn func(r *Reader, i int) error) (n int, err error) {
+	var count uint16
+	if count, err = r.ReadUint16(); err != nil {
+		return
+	}
+	n = int(count)
+	for i := 0; i < n; i++ {
+		if err = fn(r, i); err != nil {
+			return
+		}
+	}
+	return
+}
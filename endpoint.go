@@ -2,11 +2,17 @@ package datagram
 
 import (
 	"bytes"
+	"context"
+	"log/slog"
 	"net"
+	"net/netip"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gbkr-com/app"
+	"golang.org/x/time/rate"
 )
 
 // An Endpoint for communication via UDP. Sending a UDP payload is done by:
@@ -25,11 +31,70 @@ import (
 // sending and receiving.
 type Endpoint struct {
 	protocol *Protocol
-	sequence uint64                   // Last written sequence number.
-	conn     *net.UDPConn             // The underlying connection.
-	zero     []byte                   // A zero filled payload.
-	buffers  *app.Pool[*bytes.Buffer] // Pool of payload buffers, used by readers and writers.
-	writers  *app.Pool[*Writer]       // Pool of writers.
+	hash     uint64                        // The protocol hash.
+	sequence uint64                        // Last written sequence number.
+	conn     *net.UDPConn                  // The underlying connection.
+	zero     []byte                        // A zero filled payload.
+	buffers  *bufferPool                   // Pool of payload buffers, used by readers and writers.
+	writers  *app.Pool[*Writer]            // Pool of writers.
+	pool     int                           // Capacity of each pool.
+	payload  int                           // The maximum payload size.
+	limit    int                           // The maximum payload size for writers.
+	maxBody  int                           // The maximum received body size, if not zero.
+	userData any                           // Opaque application value.
+	handlers map[uint8]func(*Reader) error // Version handlers for ReceiveDispatch.
+	//
+	// Per remote sequence tracking, if enabled.
+	//
+	lock      sync.Mutex // Guards peers, expected, sources and tick.
+	tick      uint64     // Counts uses of peers and sources, to find the least recent.
+	peers     map[netip.AddrPort]*peer
+	migration bool                      // Follow peers to new addresses.
+	expected  map[uint64]netip.AddrPort // Established peers by their next sequence, for migration.
+	//
+	// Per remote rate limiting, if enabled.
+	//
+	sourceRate int
+	sources    map[netip.AddrPort]*source
+	//
+	// Optional behaviour.
+	//
+	oversize     bool                              // Allow payloads beyond MaxPayload.
+	onReject     func(*net.UDPAddr, string)        // Called when a datagram is rejected.
+	limiter      *rate.Limiter                     // Outbound rate limit.
+	noWait       bool                              // Fail rather than wait for the limiter.
+	deadLetter   func([]byte, *net.UDPAddr, error) // Called when a send fails.
+	ecn          bool                              // Receive the ECN codepoint.
+	pooledRead   bool                              // Read returns pooled slices.
+	slices       *app.Pool[[]byte]                 // Pool of slices for Read, if enabled.
+	onPort       func(int)                         // Called with the bound port.
+	receiveOnly  bool                              // Never sends, so there are no writers.
+	sendOnly     bool                              // Never receives.
+	rawRead      bool                              // Readers start at the header.
+	arena        int                               // Payload buffers per slab, if not zero.
+	dontFragment bool                              // Set the DF bit on sent datagrams.
+	ring         *ReaderRing                       // Readers for ReceiveRing, if enabled.
+	shutdown     atomic.Bool                       // Set by Shutdown.
+	fec          *fec                              // Forward error correction, if enabled.
+	reuse        reuse                             // The reader and address for ReceiveReuse.
+	filter       func([]byte, *net.UDPAddr) bool   // Admits received datagrams, if set.
+	logger       *slog.Logger                      // Logs events, if set.
+	capture      int                               // Datagrams per CaptureBatch.
+	addresses    int                               // The most remote addresses to keep state for.
+	batches      *app.Pool[*CaptureBatch]          // Pool of batches, made by the first Capture.
+	batchesOnce  sync.Once                         // Makes batches.
+	//
+	// Send pacing, if enabled.
+	//
+	gap      time.Duration // The minimum time between sends.
+	paceLock sync.Mutex    // Guards paceNext.
+	paceNext time.Time     // The earliest time for the next send.
+	//
+	// Payloads waiting for FlushQueue.
+	//
+	queueLock  sync.Mutex // Guards queue and queueOrder.
+	queue      sendQueue
+	queueOrder uint64
 }
 
 // A Connection is the connection between this end point and a remote UDP address.
@@ -38,30 +103,104 @@ type Connection struct {
 }
 
 // NewEndpoint returns a UDP end point that is connected to the network.
-// The pool specifies how many buffers to keep for recycing.
+// The pool specifies how many buffers to keep for recycing. The end point can
+// be configured further with options such as WithOnReject. ErrInvalidPort is
+// returned if the port is negative.
 //
 // This function will panic in a number of circumstances:
 //   - if the protocol is nil.
 //   - if the given protocol payload is zero or greater than MaxPayload.
+//   - if the protocol has both a hash and a hash string.
 //   - if the protocol requires verification but the payload size is less than 8 bytes.
-//   - if the port is negative.
+//   - if the protocol FrameLengthBytes is not 0, 1, 2 or 4.
+//   - if the protocol is Timestamped and has a Codec.
 //   - if the pool size is less than one.
-func NewEndpoint(protocol *Protocol, port, pool int) (*Endpoint, error) {
+//   - if the WithPayload option is zero or too large.
+//   - if the protocol pads to more than the payload or less than the header and checksum.
+//   - if the WithReaderRing option is less than one.
+//   - if the WithFEC group sizes are out of range or the payload is too small for FEC.
+//   - if the WithCaptureBatch option is less than one.
+//   - if the WithAddressLimit option is less than one.
+func NewEndpoint(protocol *Protocol, port, pool int, options ...func(*Endpoint)) (*Endpoint, error) {
+	return newEndpoint(protocol, port, pool, nil, options...)
+}
+
+// newEndpoint makes the end point, with its own pools unless it is given
+// shared ones.
+func newEndpoint(protocol *Protocol, port, pool int, shared *SharedPool, options ...func(*Endpoint)) (*Endpoint, error) {
 	if protocol == nil {
 		panic("protocol")
 	}
 	if protocol.Payload == 0 || protocol.Payload > MaxPayload {
 		panic("payload")
 	}
-	if protocol.Hash > 0 && protocol.Payload < 8 {
+	if protocol.Hash > 0 && protocol.HashString != "" {
+		panic("hash")
+	}
+	if protocol.hashed() && protocol.Payload < 8 {
 		panic("hash")
 	}
+	if protocol.Timestamped && protocol.Codec != nil {
+		panic("timestamp")
+	}
+	switch protocol.FrameLengthBytes {
+	case 0, 1, 2, 4:
+	default:
+		panic("frame")
+	}
 	if port < 0 {
-		panic("port")
+		return nil, ErrInvalidPort
 	}
 	if pool < 1 {
 		panic("pool")
 	}
+	e := &Endpoint{
+		protocol:  protocol,
+		hash:      protocol.hash(),
+		pool:      pool,
+		payload:   int(protocol.Payload),
+		capture:   DefaultCaptureBatch,
+		addresses: DefaultAddressLimit,
+	}
+	for _, opt := range options {
+		opt(e)
+	}
+	limit := int(MaxPayload)
+	if e.oversize {
+		limit = int(MaxOversizePayload)
+	}
+	if e.payload == 0 || e.payload > limit {
+		panic("payload")
+	}
+	if e.ring != nil && len(e.ring.readers) < 1 {
+		panic("ring")
+	}
+	if e.capture < 1 {
+		panic("capture")
+	}
+	if e.addresses < 1 {
+		panic("addresses")
+	}
+	if shared != nil && e.payload > shared.payload {
+		panic("shared")
+	}
+	e.limit = e.payload
+	if e.fec != nil {
+		e.fec.limit = e.addresses
+		if e.fec.data < 1 || e.fec.data > 255 || e.fec.parity < 1 || e.fec.parity > 255 {
+			panic("fec")
+		}
+		if e.limit -= fecOverhead; e.limit < protocol.headerSize()+protocol.trailerSize() {
+			panic("fec")
+		}
+	}
+	if pad := int(protocol.PadTo); pad > 0 {
+		if pad > e.limit || pad < protocol.headerSize()+protocol.trailerSize() {
+			panic("pad")
+		}
+		e.limit = pad
+	}
+	e.limit -= protocol.trailerSize()
 	//
 	// Make the net.UDPConn.
 	//
@@ -77,35 +216,48 @@ func NewEndpoint(protocol *Protocol, port, pool int) (*Endpoint, error) {
 	if err != nil {
 		return nil, err
 	}
+	if e.ecn {
+		if err = enableECN(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if e.dontFragment {
+		if err = enableDontFragment(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if e.onPort != nil {
+		e.onPort(conn.LocalAddr().(*net.UDPAddr).Port)
+	}
 	//
 	// Return the end point.
 	//
-	e := &Endpoint{
-		protocol: protocol,
-		conn:     conn,
-		zero:     make([]byte, protocol.Payload),
-		buffers: app.NewPool(
-			pool,
-			app.WithPoolFactory(
-				func() *bytes.Buffer {
-					buffer := new(bytes.Buffer)
-					buffer.Grow(int(protocol.Payload))
-					return buffer
-				},
-			),
-			app.WithPoolReset(
-				func(b *bytes.Buffer) {
-					b.Reset()
-				},
-			),
-			app.WithPoolDiscard[*bytes.Buffer](),
-		),
-		writers: app.NewPool(
+	e.conn = conn
+	if e.sendOnly {
+		e.zero = make([]byte, e.protocol.PadTo) // Only needed for padding.
+	} else {
+		e.zero = make([]byte, e.payload)
+	}
+	if shared != nil {
+		e.buffers = shared.buffers
+	} else {
+		e.buffers = newBufferPool(pool, int(protocol.Payload), e.payload, e.arena)
+	}
+	if e.pooledRead {
+		e.slices = app.NewPool(
 			pool,
-			app.WithPoolFactory(func() *Writer { return &Writer{} }),
-			app.WithPoolReset(func(w *Writer) { w.buffer = nil }),
-			app.WithPoolDiscard[*Writer](),
-		),
+			app.WithPoolFactory(func() []byte { return make([]byte, 0, e.payload) }),
+			app.WithPoolDiscard[[]byte](),
+		)
+	}
+	switch {
+	case e.receiveOnly:
+	case shared != nil:
+		e.writers = shared.writers
+	default:
+		e.writers = newWriterPool(pool)
 	}
 	return e, nil
 }
@@ -115,6 +267,24 @@ func (e *Endpoint) LocalAddress() *net.UDPAddr {
 	return e.conn.LocalAddr().(*net.UDPAddr)
 }
 
+// HeaderSize returns the number of bytes taken by the protocol header, which is
+// the offset at which the body begins in a raw datagram.
+func (e *Endpoint) HeaderSize() int {
+	return e.protocol.headerSize()
+}
+
+// Conn returns the underlying UDP connection, for example to set socket options
+// that are not otherwise available. The caller is responsible for any use that
+// would conflict with Send and Receive, such as changing the deadlines.
+func (e *Endpoint) Conn() *net.UDPConn {
+	return e.conn
+}
+
+// LocalPort returns the port of this end point.
+func (e *Endpoint) LocalPort() int {
+	return e.LocalAddress().Port
+}
+
 // LastSequence returns the last written sequence number.
 func (e *Endpoint) LastSequence() uint64 {
 	return e.sequence
@@ -125,33 +295,113 @@ func (e *Endpoint) SetSequence(seq uint64) {
 	e.sequence = seq
 }
 
-func (e *Endpoint) incr() {
+// SetMaxReceiveBody limits the body of received payloads, after the protocol
+// header, to n bytes. Receive returns ErrOversize for any larger payload. A
+// limit of zero or less removes the limit.
+func (e *Endpoint) SetMaxReceiveBody(n int) {
+	e.maxBody = n
+}
+
+// UserData returns the value given to SetUserData.
+func (e *Endpoint) UserData() any {
+	return e.userData
+}
+
+// SetUserData stores an opaque application value with this end point, such as
+// an identifier or configuration.
+func (e *Endpoint) SetUserData(v any) {
+	e.userData = v
+}
+
+// NextSequence increments the last written sequence number and returns it.
+// This is for a HeaderCodec writing its own header.
+func (e *Endpoint) NextSequence() uint64 {
 	e.sequence++
+	return e.sequence
 }
 
-// Writer returns a new writer.
+// Warm refills the buffer and writer pools to capacity after they have been
+// drained, for example by readers that were never closed, so that the
+// allocation cost is paid now rather than by later calls to Writer() and
+// Receive(). The pools are already full when the end point is made, so this
+// does nothing on a new end point.
+func (e *Endpoint) Warm() {
+	buffers := make([]*bytes.Buffer, e.pool)
+	for i := range buffers {
+		buffers[i] = e.buffers.Next()
+	}
+	for _, buffer := range buffers {
+		e.buffers.Recycle(buffer)
+	}
+	if e.writers == nil {
+		return
+	}
+	writers := make([]*Writer, e.pool)
+	for i := range writers {
+		writers[i] = e.writers.Next()
+	}
+	for _, writer := range writers {
+		e.writers.Recycle(writer)
+	}
+}
+
+// Writer returns a new writer. For an end point made WithReceiveOnly, every
+// write to the writer returns ErrReceiveOnly, as does sending it.
 func (e *Endpoint) Writer() *Writer {
+	if e.writers == nil {
+		return &Writer{err: ErrReceiveOnly}
+	}
 	w := e.writers.Next()
 	w.buffer = e.buffers.Next()
-	if e.protocol.Hash > 0 {
-		protocolWrite(e.protocol, w)
-	}
-	if e.protocol.Sequenced {
-		sequenceWrite(e, w)
-	}
+	w.limit = e.limit
+	w.frame = e.protocol.frameLengthBytes()
+	w.err = headerWrite(e, w) // Returned by every later write and by Send.
+	w.header = w.buffer.Len()
 	return w
 }
 
 // Send the UDP payload in the writer from this end point. The writer should not
 // be used again after this call.
-func (e *Endpoint) Send(writer *Writer, address *net.UDPAddr, timeout time.Duration) (err error) {
-	if timeout > 0 {
-		if err := e.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
-			return err
+func (e *Endpoint) Send(writer *Writer, address *net.UDPAddr, timeout time.Duration) error {
+	return e.sendWriter(context.Background(), writer, target{udp: address}, timeout)
+}
+
+// SendContext sends the UDP payload in the writer, as Send, but with a timeout
+// taken from the deadline of the context, if any. The send is abandoned if the
+// context is cancelled while waiting for the rate limiter or the socket, and an
+// OpError wrapping the context error is returned.
+func (e *Endpoint) SendContext(ctx context.Context, writer *Writer, address *net.UDPAddr) error {
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			timeout = time.Nanosecond
 		}
 	}
-	_, err = e.conn.WriteToUDP(writer.buffer.Bytes(), address)
-	if err != nil {
+	return e.sendWriter(ctx, writer, target{udp: address}, timeout)
+}
+
+// SendAddrPort is the same as Send but to a netip.AddrPort, which saves
+// converting the address to a *net.UDPAddr.
+func (e *Endpoint) SendAddrPort(writer *Writer, address netip.AddrPort, timeout time.Duration) error {
+	return e.sendWriter(context.Background(), writer, target{addrPort: address}, timeout)
+}
+
+func (e *Endpoint) sendWriter(ctx context.Context, writer *Writer, to target, timeout time.Duration) (err error) {
+	if err = writer.err; err != nil {
+		e.discard(writer)
+		return
+	}
+	if e.protocol.Timestamped {
+		timestampWrite(e, writer)
+	}
+	if e.protocol.PadTo > 0 {
+		padWrite(e, writer)
+	}
+	if e.protocol.checksummed() {
+		checksumWrite(e, writer)
+	}
+	if err = e.transmit(ctx, writer.buffer.Bytes(), to, timeout); err != nil {
+		e.failed(writer.buffer.Bytes(), to, err)
 		return
 	}
 	e.buffers.Recycle(writer.buffer)
@@ -159,15 +409,178 @@ func (e *Endpoint) Send(writer *Writer, address *net.UDPAddr, timeout time.Durat
 	return
 }
 
+// SendBytes sends an already encoded body from this end point, preceded by the
+// protocol header. If the protocol has no header or checksum the body is sent as
+// it is.
+func (e *Endpoint) SendBytes(body []byte, address *net.UDPAddr, timeout time.Duration) (err error) {
+	if e.receiveOnly {
+		return ErrReceiveOnly
+	}
+	if e.protocol.headerSize() == 0 && !e.protocol.checksummed() {
+		if len(body) > e.limit {
+			return ErrOverflow
+		}
+		to := target{udp: address}
+		if err = e.transmit(context.Background(), body, to, timeout); err != nil {
+			e.failed(body, to, err)
+		}
+		return
+	}
+	w := e.Writer()
+	if err = w.check(len(body)); err != nil {
+		e.discard(w)
+		return
+	}
+	w.buffer.Write(body)
+	return e.Send(w, address, timeout)
+}
+
+// SendTemplate sends a payload whose body starts with a template made by
+// Writer.Template, followed by anything written by the extra function, if
+// given. Nothing is sent if the extra function returns an error.
+func (e *Endpoint) SendTemplate(tmpl []byte, extra func(*Writer) error, address *net.UDPAddr, timeout time.Duration) (err error) {
+	w := e.Writer()
+	if err = w.check(len(tmpl)); err == nil {
+		w.buffer.Write(tmpl)
+		if extra != nil {
+			err = extra(w)
+		}
+	}
+	if err != nil {
+		e.discard(w)
+		return
+	}
+	return e.Send(w, address, timeout)
+}
+
+// discard returns an unsent writer and its buffer to the pools.
+func (e *Endpoint) discard(w *Writer) {
+	if w.buffer == nil {
+		return
+	}
+	e.buffers.Recycle(w.buffer)
+	e.writers.Recycle(w)
+}
+
+// Release returns a slice obtained from Reader.Read to the pool, when the
+// WithPooledRead option is used. The slice must not be used after this call.
+func (e *Endpoint) Release(b []byte) {
+	if e.slices == nil || cap(b) != e.payload {
+		return
+	}
+	e.slices.Recycle(b[:0])
+}
+
+// failed passes a copy of the payload to the WithDeadLetter function, if any.
+func (e *Endpoint) failed(payload []byte, to target, err error) {
+	if e.deadLetter == nil {
+		return
+	}
+	b := make([]byte, len(payload))
+	copy(b, payload)
+	e.deadLetter(b, to.udpAddr(), err)
+}
+
+// A target is the destination of a send, given as either kind of address.
+type target struct {
+	udp      *net.UDPAddr
+	addrPort netip.AddrPort // Used if there is no UDP address.
+	oob      []byte         // Control message for the UDP address, if any.
+}
+
+// udpAddr returns the destination as a *net.UDPAddr.
+func (t target) udpAddr() *net.UDPAddr {
+	if t.udp != nil {
+		return t.udp
+	}
+	return net.UDPAddrFromAddrPort(t.addrPort)
+}
+
+// write the payload to the destination.
+func (t target) write(conn *net.UDPConn, payload []byte) (err error) {
+	switch {
+	case t.oob != nil:
+		_, _, err = conn.WriteMsgUDP(payload, t.oob, t.udp)
+	case t.udp != nil:
+		_, err = conn.WriteToUDP(payload, t.udp)
+	default:
+		_, err = conn.WriteToUDPAddrPort(payload, t.addrPort)
+	}
+	return
+}
+
+func (e *Endpoint) send(ctx context.Context, payload []byte, to target, timeout time.Duration) (err error) {
+	if err = ctx.Err(); err != nil {
+		return e.opError(OpSend, err)
+	}
+	if e.limiter != nil {
+		if err = e.throttle(ctx, timeout); err != nil {
+			return
+		}
+	}
+	if e.gap > 0 {
+		if err = e.pace(ctx, timeout); err != nil {
+			return
+		}
+	}
+	done := ctx.Done()
+	if timeout > 0 {
+		err = e.conn.SetWriteDeadline(time.Now().Add(timeout))
+	} else if done != nil {
+		err = e.conn.SetWriteDeadline(time.Time{})
+	}
+	if err != nil {
+		return e.opError(OpSend, err)
+	}
+	//
+	// Unblock the write by setting an immediate deadline if the context is
+	// done first. Once the watcher has stopped the deadline is cleared, so
+	// that a later send without a timeout is not affected.
+	//
+	if done != nil {
+		finished := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-done:
+				e.conn.SetWriteDeadline(time.Now())
+			case <-finished:
+			}
+		}()
+		defer func() {
+			close(finished)
+			<-stopped
+			e.conn.SetWriteDeadline(time.Time{})
+		}()
+	}
+	if err = to.write(e.conn, payload); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		err = classifySend(err, len(payload))
+		return e.opError(OpSend, err)
+	}
+	return
+}
+
 // Receive a UDP payload. The returned reader is used to extract items from
 // the payload. That reader must be closed after use.
 // The returned reader may be nil: this happens when there is an error and also
 // when the incoming UDP datagram does not match the protocol.
 func (e *Endpoint) Receive(timeout time.Duration) (reader *Reader, addr *net.UDPAddr, seq uint64, err error) {
-	if timeout > 0 {
-		if err = e.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
-			return
-		}
+	reader, addr, seq, _, err = e.receive(timeout, nil)
+	return
+}
+
+// receive a UDP payload into the given reader, or a new one if that is nil.
+func (e *Endpoint) receive(timeout time.Duration, into *Reader) (reader *Reader, addr *net.UDPAddr, seq uint64, status tracking, err error) {
+	if e.sendOnly {
+		err = ErrSendOnly
+		return
+	}
+	if err = e.readDeadline(timeout); err != nil {
+		return
 	}
 	//
 	// Get a buffer and fill it, then use the underlying byte slice for the
@@ -178,34 +591,243 @@ func (e *Endpoint) Receive(timeout time.Duration) (reader *Reader, addr *net.UDP
 	bx := buffer.Bytes()
 	var n int
 	if n, addr, err = e.conn.ReadFromUDP(bx); err != nil {
+		e.buffers.Recycle(buffer)
+		err = e.readError(err)
+		return
+	}
+	if reader, seq, status, err = e.accept(buffer, n, addr, into); reader == nil {
+		addr = nil
+	}
+	return
+}
+
+// readDeadline sets the deadline for the next read, if there is a timeout.
+func (e *Endpoint) readDeadline(timeout time.Duration) error {
+	if e.shutdown.Load() {
+		return ErrShutdown
+	}
+	if timeout > 0 {
+		if err := e.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return e.opError(OpReceive, err)
+		}
+		//
+		// Check again in case Shutdown set its deadline before this one.
+		//
+		if e.shutdown.Load() {
+			return ErrShutdown
+		}
+	}
+	return nil
+}
+
+// readError returns ErrShutdown if the read failed because of Shutdown,
+// otherwise the error wrapped in an OpError.
+func (e *Endpoint) readError(err error) error {
+	if e.shutdown.Load() {
+		return ErrShutdown
+	}
+	err = e.opError(OpReceive, err)
+	if e.logger != nil && !IsTimeout(err) && !IsClosed(err) {
+		e.logReceive(nil, 0, 0, err)
+	}
+	return err
+}
+
+// opError wraps a network error with the operation and local address.
+func (e *Endpoint) opError(op string, err error) error {
+	return &OpError{Op: op, LocalAddr: e.conn.LocalAddr(), Err: err}
+}
+
+// accept a payload of n bytes that has been read into the buffer, checking the
+// protocol header. The reader is nil if the payload is rejected.
+func (e *Endpoint) accept(buffer *bytes.Buffer, n int, addr *net.UDPAddr, into *Reader) (reader *Reader, seq uint64, status tracking, err error) {
+	if e.filter != nil && !e.filter(buffer.Bytes()[:n], addr) {
+		e.buffers.Recycle(buffer)
+		return
+	}
+	if e.sources != nil && !e.allow(addr) {
+		e.reject(addr, RejectRate)
+		e.buffers.Recycle(buffer)
 		return
 	}
+	if e.fec != nil {
+		var (
+			ok     bool
+			reason string
+		)
+		if n, ok, reason = e.fec.receive(buffer.Bytes()[:n], addr); !ok {
+			if reason != "" {
+				e.reject(addr, reason)
+			}
+			e.buffers.Recycle(buffer)
+			return
+		}
+	}
 	//
 	// Although the byte slice has been manipulated outside of the buffer we can
 	// still get the buffer back to normal by truncating to the number of bytes
 	// put into the slice by the ReadFromUDP.
 	//
 	buffer.Truncate(n)
-	reader = &Reader{
+	if e.protocol.checksummed() && !e.rawRead && !checksumRead(e, buffer) {
+		e.reject(addr, RejectChecksum)
+		e.buffers.Recycle(buffer)
+		return
+	}
+	if into == nil {
+		into = new(Reader)
+	}
+	*into = Reader{
 		buffer:   buffer,
 		endpoint: e,
+		length:   n,
+		body:     n,
 	}
-	if e.protocol.Hash > 0 {
-		var ok bool
-		ok, err = protocolRead(e.protocol, reader)
-		if err != nil || !ok {
-			reader = nil
-			addr = nil
-			return
+	reader = into
+	if e.rawRead {
+		return
+	}
+	var reason string
+	if seq, reason, err = headerRead(e, reader); err != nil || reason != "" {
+		if reason != "" {
+			e.reject(addr, reason)
+		} else if e.logger != nil {
+			e.logReceive(addr, n, 0, err)
 		}
+		e.buffers.Recycle(buffer)
+		reader.buffer = nil
+		reader = nil
+		return
+	}
+	if e.maxBody > 0 && reader.Remaining() > e.maxBody {
+		e.buffers.Recycle(buffer)
+		reader.buffer = nil
+		reader = nil
+		err = ErrOversize
+		if e.logger != nil {
+			e.logReceive(addr, n, 0, err)
+		}
+		return
+	}
+	reader.body = reader.buffer.Len()
+	reader.fields = 0 // Not counting the header.
+	if e.protocol.Sequenced && e.peers != nil {
+		status = e.track(addr, seq)
 	}
-	if e.protocol.Sequenced {
-		seq, err = sequenceRead(e, reader)
+	if e.logger != nil {
+		e.logReceive(addr, n, seq, nil)
 	}
 	return
 }
 
-// Close this end point.
+// throttle waits for the rate limiter to permit a send, unless that would take
+// longer than the timeout, the WithRateLimitNoWait option has been used or the
+// context is done.
+func (e *Endpoint) throttle(ctx context.Context, timeout time.Duration) error {
+	if e.noWait {
+		if !e.limiter.Allow() {
+			return ErrRateLimited
+		}
+		return nil
+	}
+	r := e.limiter.Reserve()
+	if !r.OK() {
+		return ErrRateLimited
+	}
+	delay := r.Delay()
+	if timeout > 0 && delay > timeout {
+		r.Cancel()
+		return ErrRateLimited
+	}
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return e.opError(OpSend, ctx.Err())
+	}
+}
+
+// pace waits until at least the WithPacing gap has passed since the previous
+// send, returning ErrRateLimited if that would take longer than the timeout.
+// The times have a monotonic clock reading, so the spacing does not drift with
+// changes to the wall clock.
+func (e *Endpoint) pace(ctx context.Context, timeout time.Duration) error {
+	e.paceLock.Lock()
+	now := time.Now()
+	at := e.paceNext
+	if at.Before(now) {
+		at = now
+	}
+	delay := at.Sub(now)
+	if timeout > 0 && delay > timeout {
+		e.paceLock.Unlock()
+		return ErrRateLimited
+	}
+	e.paceNext = at.Add(e.gap)
+	e.paceLock.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return e.opError(OpSend, ctx.Err())
+	}
+}
+
+// A source is the WithSourceRateLimit limiter for one remote address.
+type source struct {
+	limiter *rate.Limiter
+	used    uint64 // The tick when last used.
+}
+
+// allow returns false if the remote address has exceeded the
+// WithSourceRateLimit rate.
+func (e *Endpoint) allow(addr *net.UDPAddr) bool {
+	key := addrPort(addr)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	s, ok := e.sources[key]
+	if !ok {
+		if len(e.sources) >= e.addresses {
+			evict(e.sources, func(s *source) uint64 { return s.used })
+		}
+		s = &source{limiter: rate.NewLimiter(rate.Limit(e.sourceRate), e.sourceRate)}
+		e.sources[key] = s
+	}
+	e.tick++
+	s.used = e.tick
+	return s.limiter.Allow()
+}
+
+func (e *Endpoint) reject(addr *net.UDPAddr, reason string) {
+	if e.logger != nil {
+		e.logReject(addr, reason)
+	}
+	if e.onReject != nil {
+		e.onReject(addr, reason)
+	}
+}
+
+// Shutdown unblocks any pending Receive, which returns ErrShutdown, as do all
+// later calls to receive. Unlike Close, the connection stays open so that the
+// end point can still send. Close must still be called to release the port.
+func (e *Endpoint) Shutdown() error {
+	e.shutdown.Store(true)
+	return e.conn.SetReadDeadline(time.Now())
+}
+
+// Close this end point. UDP has no lingering state, so the port is released
+// immediately and can be bound again by a new end point.
 func (e *Endpoint) Close() error {
 	return e.conn.Close()
 }
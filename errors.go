@@ -2,11 +2,55 @@ package datagram
 
 import (
 	"errors"
+	"net"
 )
 
 // Errors for this package.
 var (
-	ErrOverflow     = errors.New("overflow")
-	ErrClosedWriter = errors.New("closed writer")
-	ErrClosedReader = errors.New("closed reader")
+	ErrOverflow           = errors.New("overflow")
+	ErrClosedWriter       = errors.New("closed writer")
+	ErrClosedReader       = errors.New("closed reader")
+	ErrRateLimited        = errors.New("rate limited")
+	ErrInvalidLength      = errors.New("invalid length")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	ErrInvalidSchema      = errors.New("invalid schema")
+	ErrReceiveOnly        = errors.New("receive only")
+	ErrSendOnly           = errors.New("send only")
+	ErrOversize           = errors.New("oversize")
+	ErrTrailingData       = errors.New("trailing data")
+	ErrMessageTooLarge    = errors.New("message too large")
+	ErrRingFull           = errors.New("ring full")
+	ErrShutdown           = errors.New("shutdown")
+	ErrNotSupported       = errors.New("not supported on this platform")
+	ErrInvalidAddress     = errors.New("invalid address")
+	ErrNonCanonical       = errors.New("non-canonical encoding")
+	ErrUnsequenced        = errors.New("protocol not sequenced")
+	ErrNotAcknowledged    = errors.New("not acknowledged")
+	ErrFieldCount         = errors.New("field count mismatch")
+	ErrNotRawRead         = errors.New("reader not raw")
+	ErrInvalidPort        = errors.New("invalid port")
+	ErrReleasedBatch      = errors.New("released batch")
 )
+
+// Operations given in an OpError.
+const (
+	OpSend    = "send"
+	OpReceive = "receive"
+)
+
+// An OpError wraps a network error from Send or Receive with the operation and
+// the local address of the end point. The underlying error can be examined with
+// errors.Is and errors.As, so IsTimeout and IsClosed still apply.
+type OpError struct {
+	Op        string
+	LocalAddr net.Addr
+	Err       error
+}
+
+func (e *OpError) Error() string {
+	return "datagram " + e.Op + " " + e.LocalAddr.String() + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,30 @@
+package datagram
+
+import (
+	"net/netip"
+)
+
+// DefaultAddressLimit is the most remote addresses for which an end point
+// keeps state, such as for forward error correction, unless the
+// WithAddressLimit option is given.
+const DefaultAddressLimit = 4096
+
+// evictSample is the number of entries looked at to choose one to evict.
+const evictSample = 8
+
+// evict removes the least recently used of a sample of the entries in the map,
+// to make room for another, and returns it. Map iteration starts at a random
+// entry, so this takes the same time however large the map.
+func evict[V any](m map[netip.AddrPort]V, used func(V) uint64) (key netip.AddrPort, value V) {
+	n := 0
+	for k, v := range m {
+		if n == 0 || used(v) < used(value) {
+			key, value = k, v
+		}
+		if n++; n == evictSample {
+			break
+		}
+	}
+	delete(m, key)
+	return
+}
@@ -0,0 +1,238 @@
+package datagram
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Forward error correction, enabled by WithFEC, groups the datagrams sent to
+// each address and follows every group with parity datagrams holding the XOR
+// of the group, from which the receiver can rebuild any one missing datagram.
+// Every datagram on the wire starts with an FEC header:
+//
+//	kind  uint8  fecData or fecParity
+//	group uint32 the group number, counted per destination
+//	index uint8  the position in the group, or the parity number
+//
+// A parity datagram continues with the XOR of the data lengths, as a uint16,
+// and then the XOR of the data, each zero extended to the longest in the group.
+const (
+	fecData       = 0
+	fecParity     = 1
+	fecHeaderSize = 6
+	fecOverhead   = fecHeaderSize + 2 // The most a datagram grows on the wire.
+)
+
+// fecLate is how many groups behind the current one a datagram can be and
+// still be taken as late rather than from a sender that has started again.
+const fecLate = 16
+
+type fec struct {
+	data   int // Data datagrams per group.
+	parity int // Parity datagrams per group.
+	limit  int // The most destinations and sources to keep.
+	lock   sync.Mutex
+	tick   uint64 // Counts uses of the map entries, to find the least recent.
+	out    map[netip.AddrPort]*fecSender
+	in     map[netip.AddrPort]*fecReceiver
+}
+
+// A fecSender accumulates the parity of the current group to one destination.
+type fecSender struct {
+	group  uint32
+	count  int    // The data datagrams sent in the group.
+	length uint16 // The XOR of their lengths.
+	size   int    // The longest of them.
+	xor    []byte
+	used   uint64 // The tick when last used.
+}
+
+// A fecReceiver holds copies of the datagrams received in the current group
+// from one source.
+type fecReceiver struct {
+	group     uint32
+	datagrams [][]byte
+	have      []bool
+	recovered bool   // A missing datagram has been rebuilt for the group.
+	used      uint64 // The tick when last used.
+}
+
+// key returns the destination as a comparable key, like addrPort.
+func (t target) key() netip.AddrPort {
+	if t.udp != nil {
+		return addrPort(t.udp)
+	}
+	return netip.AddrPortFrom(t.addrPort.Addr().Unmap(), t.addrPort.Port())
+}
+
+// transmit sends the payload, with forward error correction if enabled.
+func (e *Endpoint) transmit(ctx context.Context, payload []byte, to target, timeout time.Duration) (err error) {
+	if e.fec == nil {
+		err = e.send(ctx, payload, to, timeout)
+	} else {
+		err = e.fec.send(ctx, e, payload, to, timeout)
+	}
+	if e.logger != nil {
+		e.logSend(payload, to, err)
+	}
+	return
+}
+
+// send the payload as the next datagram in the group for the destination, then
+// the parity datagrams if that completes the group. The first error is
+// returned.
+func (f *fec) send(ctx context.Context, e *Endpoint, payload []byte, to target, timeout time.Duration) (err error) {
+	frame := e.buffers.Next()
+	defer e.buffers.Recycle(frame)
+	var parity *bytes.Buffer
+	var head [fecHeaderSize]byte
+	key := to.key()
+	f.lock.Lock()
+	g, ok := f.out[key]
+	if !ok {
+		if len(f.out) >= f.limit {
+			evict(f.out, func(g *fecSender) uint64 { return g.used })
+		}
+		//
+		// Start from a random group so that a receiver still holding the
+		// groups of an earlier sender is unlikely to take these as late.
+		//
+		g = &fecSender{group: rand.Uint32(), xor: make([]byte, e.payload)}
+		f.out[key] = g
+	}
+	f.tick++
+	g.used = f.tick
+	head[0] = fecData
+	binary.BigEndian.PutUint32(head[1:], g.group)
+	head[5] = byte(g.count)
+	for i, b := range payload {
+		g.xor[i] ^= b
+	}
+	g.length ^= uint16(len(payload))
+	if len(payload) > g.size {
+		g.size = len(payload)
+	}
+	if g.count++; g.count == f.data {
+		parity = e.buffers.Next()
+		parity.WriteByte(fecParity)
+		parity.Write(head[1:5])
+		parity.WriteByte(0)
+		binary.Write(parity, binary.BigEndian, g.length)
+		parity.Write(g.xor[:g.size])
+		for i := range g.xor[:g.size] {
+			g.xor[i] = 0
+		}
+		g.group++
+		g.count, g.length, g.size = 0, 0, 0
+	}
+	f.lock.Unlock()
+	frame.Write(head[:])
+	frame.Write(payload)
+	err = e.send(ctx, frame.Bytes(), to, timeout)
+	if parity == nil {
+		return
+	}
+	defer e.buffers.Recycle(parity)
+	b := parity.Bytes()
+	for i := 0; i < f.parity; i++ {
+		b[5] = byte(i)
+		if perr := e.send(ctx, b, to, timeout); err == nil {
+			err = perr
+		}
+	}
+	return
+}
+
+// receive handles the FEC header of the datagram in b, leaving the original
+// datagram at the start of b and returning its length. This is either the
+// data datagram itself or, for a parity datagram, the one missing from the
+// group. The result is false if there is nothing to deliver, and the reason is
+// given if the datagram was malformed.
+func (f *fec) receive(b []byte, addr *net.UDPAddr) (n int, ok bool, reason string) {
+	if len(b) < fecHeaderSize || b[0] > fecParity || (b[0] == fecData && int(b[5]) >= f.data) {
+		return 0, false, RejectFEC
+	}
+	kind, group, index := b[0], binary.BigEndian.Uint32(b[1:]), int(b[5])
+	key := addrPort(addr)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	g, found := f.in[key]
+	if !found {
+		if len(f.in) >= f.limit {
+			evict(f.in, func(g *fecReceiver) uint64 { return g.used })
+		}
+		g = &fecReceiver{
+			group:     group,
+			datagrams: make([][]byte, f.data),
+			have:      make([]bool, f.data),
+		}
+		f.in[key] = g
+	}
+	f.tick++
+	g.used = f.tick
+	if behind := int32(g.group - group); behind < 0 || behind > fecLate {
+		g.group = group
+		for i := range g.have {
+			g.have[i] = false
+		}
+		g.recovered = false
+	}
+	if kind == fecData {
+		//
+		// Drop a late datagram from an earlier group, or one already
+		// received or rebuilt from the parity, so it is not delivered twice.
+		//
+		if group != g.group || g.have[index] {
+			return 0, false, ""
+		}
+		g.datagrams[index] = append(g.datagrams[index][:0], b[fecHeaderSize:]...)
+		g.have[index] = true
+		return copy(b, b[fecHeaderSize:]), true, ""
+	}
+	if len(b) < fecOverhead {
+		return 0, false, RejectFEC
+	}
+	if group != g.group || g.recovered {
+		return 0, false, ""
+	}
+	missing := -1
+	for i, have := range g.have {
+		if have {
+			continue
+		}
+		if missing >= 0 {
+			return 0, false, "" // Too many lost to recover.
+		}
+		missing = i
+	}
+	if missing < 0 {
+		return 0, false, ""
+	}
+	length := binary.BigEndian.Uint16(b[fecHeaderSize:])
+	xor := b[fecOverhead:]
+	for i, have := range g.have {
+		if !have {
+			continue
+		}
+		d := g.datagrams[i]
+		if len(d) > len(xor) {
+			return 0, false, RejectFEC
+		}
+		length ^= uint16(len(d))
+		for j, v := range d {
+			xor[j] ^= v
+		}
+	}
+	if int(length) > len(xor) {
+		return 0, false, RejectFEC
+	}
+	g.recovered = true
+	g.have[missing] = true
+	return copy(b, xor[:length]), true, ""
+}
@@ -1,10 +1,12 @@
 module github.com/gbkr-com/datagram
 
-go 1.20
+go 1.21
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/gbkr-com/app v0.2.0
 	github.com/stretchr/testify v1.8.2
+	golang.org/x/time v0.5.0
 )
 
 require (
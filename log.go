@@ -0,0 +1,97 @@
+package datagram
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+)
+
+// Attribute keys used in log records.
+const (
+	LogLocal  = "local"  // The local address of the end point.
+	LogRemote = "remote" // The remote address.
+	LogBytes  = "bytes"  // The payload size.
+	LogSeq    = "seq"    // The sequence number, for a Sequenced protocol.
+	LogReason = "reason" // One of the Reject reasons.
+	LogError  = "error"  // The error.
+)
+
+// logging returns true if there is a logger and it is enabled for the level.
+func (e *Endpoint) logging(level slog.Level) bool {
+	return e.logger != nil && e.logger.Enabled(context.Background(), level)
+}
+
+// logSend logs a payload sent, or failing to send, to the destination.
+func (e *Endpoint) logSend(payload []byte, to target, err error) {
+	level, msg := slog.LevelDebug, "send"
+	if err != nil {
+		level, msg = slog.LevelWarn, "send failed"
+	}
+	if !e.logging(level) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String(LogLocal, e.conn.LocalAddr().String()),
+		slog.String(LogRemote, to.udpAddr().String()),
+		slog.Int(LogBytes, len(payload)),
+	}
+	if seq, ok := e.payloadSequence(payload); ok {
+		attrs = append(attrs, slog.Uint64(LogSeq, seq))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String(LogError, err.Error()))
+	}
+	e.logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// logReceive logs a payload received, or failing to be, from the address. The
+// address is nil if nothing was read.
+func (e *Endpoint) logReceive(addr *net.UDPAddr, n int, seq uint64, err error) {
+	level, msg := slog.LevelDebug, "receive"
+	if err != nil {
+		level, msg = slog.LevelWarn, "receive failed"
+	}
+	if !e.logging(level) {
+		return
+	}
+	attrs := []slog.Attr{slog.String(LogLocal, e.conn.LocalAddr().String())}
+	if addr != nil {
+		attrs = append(attrs, slog.String(LogRemote, addr.String()), slog.Int(LogBytes, n))
+	}
+	if e.protocol.Sequenced && err == nil {
+		attrs = append(attrs, slog.Uint64(LogSeq, seq))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String(LogError, err.Error()))
+	}
+	e.logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// logReject logs a datagram rejected for the reason.
+func (e *Endpoint) logReject(addr *net.UDPAddr, reason string) {
+	if !e.logging(slog.LevelWarn) {
+		return
+	}
+	e.logger.LogAttrs(context.Background(), slog.LevelWarn, "reject",
+		slog.String(LogLocal, e.conn.LocalAddr().String()),
+		slog.String(LogRemote, addr.String()),
+		slog.String(LogReason, reason),
+	)
+}
+
+// payloadSequence returns the sequence number from the header of an encoded
+// payload, if the protocol has one without a Codec.
+func (e *Endpoint) payloadSequence(payload []byte) (seq uint64, ok bool) {
+	if !e.protocol.Sequenced || e.protocol.Codec != nil {
+		return
+	}
+	offset := 0
+	if e.protocol.hashed() {
+		offset = 8
+	}
+	if len(payload) < offset+8 {
+		return
+	}
+	return binary.BigEndian.Uint64(payload[offset:]), true
+}
@@ -0,0 +1,33 @@
+package datagram
+
+import (
+	"errors"
+	"strconv"
+	"syscall"
+)
+
+// A MessageTooLargeError is returned, within an OpError, when a send fails
+// because the payload is larger than the path MTU allows, which can happen with
+// WithDontFragment. It matches both ErrMessageTooLarge and the underlying
+// syscall error with errors.Is.
+type MessageTooLargeError struct {
+	Size int // The size of the payload that could not be sent.
+	Err  error
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return "message too large: " + strconv.Itoa(e.Size) + " bytes"
+}
+
+func (e *MessageTooLargeError) Unwrap() []error {
+	return []error{ErrMessageTooLarge, e.Err}
+}
+
+// classifySend returns a MessageTooLargeError if the error from sending a
+// payload of the given size is EMSGSIZE, otherwise the error itself.
+func classifySend(err error, size int) error {
+	if errors.Is(err, syscall.EMSGSIZE) {
+		return &MessageTooLargeError{Size: size, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+package datagram
+
+import (
+	"net"
+	"syscall"
+)
+
+func enableDontFragment(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		//
+		// The socket may be IPv4 only, or dual stack, so try both levels.
+		//
+		err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+		if err4 != nil && err6 != nil {
+			serr = err4
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
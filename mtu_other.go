@@ -0,0 +1,11 @@
+//go:build !linux
+
+package datagram
+
+import (
+	"net"
+)
+
+func enableDontFragment(conn *net.UDPConn) error {
+	return nil
+}
@@ -0,0 +1,281 @@
+package datagram
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Reasons given to the WithOnReject callback.
+const (
+	RejectHash     = "hash"     // The protocol hash did not match.
+	RejectHeader   = "header"   // The HeaderCodec did not accept the header.
+	RejectPadding  = "padding"  // The padded body length was invalid.
+	RejectRate     = "rate"     // The source exceeded WithSourceRateLimit.
+	RejectChecksum = "checksum" // The protocol checksum did not match.
+	RejectFEC      = "fec"      // The forward error correction header was invalid.
+	RejectStale    = "stale"    // The header time was outside the ClockSkew.
+	RejectSequence = "sequence" // The sequence number was zero, with RejectZeroSequence.
+)
+
+// WithOnReject returns an option to call the given function whenever Receive
+// rejects an incoming UDP datagram, for example because the protocol hash did
+// not match. The function is given the source address and one of the Reject
+// reasons and is called before Receive returns the nil reader.
+func WithOnReject(fn func(addr *net.UDPAddr, reason string)) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.onReject = fn
+	}
+}
+
+// WithPayload returns an option to override the protocol payload size for this
+// end point. The size cannot be greater than MaxPayload unless the
+// WithAllowOversize option is also given.
+func WithPayload(n uint16) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.payload = int(n)
+	}
+}
+
+// WithAllowOversize returns an option that allows the WithPayload size to be
+// as large as MaxOversizePayload. Buffers start at the protocol payload size
+// and grow as needed up to that limit.
+//
+// Warning: datagrams larger than MaxPayload cannot be carried over IPv4 at all
+// and rely on IP fragmentation over IPv6. This option is only intended for use
+// over the IPv6 loopback interface, between processes on the same host.
+func WithAllowOversize() func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.oversize = true
+	}
+}
+
+// WithPeerTracking returns an option to track the sequence numbers received
+// from each remote address, for Sequenced protocols. This is needed by
+// ReceiveDedup. An entry is kept for each remote address, up to the
+// WithAddressLimit, after which the least recently used is dropped.
+func WithPeerTracking() func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.peers = make(map[netip.AddrPort]*peer)
+	}
+}
+
+// WithRateLimit returns an option to limit the rate at which Send transmits UDP
+// datagrams, allowing bursts of up to the given size. Send waits until the
+// datagram is permitted, returning ErrRateLimited if that would take longer
+// than its timeout.
+func WithRateLimit(perSecond int, burst int) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+	}
+}
+
+// WithRateLimitNoWait returns an option for Send to return ErrRateLimited
+// immediately, rather than wait, when the WithRateLimit rate is exceeded.
+func WithRateLimitNoWait() func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.noWait = true
+	}
+}
+
+// WithDeadLetter returns an option to call the given function when Send fails,
+// with a copy of the payload that could not be sent, the intended address and
+// the error.
+func WithDeadLetter(fn func(payload []byte, addr *net.UDPAddr, err error)) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.deadLetter = fn
+	}
+}
+
+// WithECN returns an option to receive the ECN codepoint of incoming datagrams,
+// see ReceiveECN. This is only supported on Linux and has no effect elsewhere.
+func WithECN() func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.ecn = true
+	}
+}
+
+// WithMigration returns an option to follow a peer to a new remote address,
+// such as a mobile client moving between networks, see ReceiveMigrated. This
+// implies WithPeerTracking. A peer is recognised only by the continuity of its
+// sequence numbers, which anyone can spoof, so this must not be relied on to
+// authenticate a peer.
+func WithMigration() func(*Endpoint) {
+	return func(e *Endpoint) {
+		if e.peers == nil {
+			e.peers = make(map[netip.AddrPort]*peer)
+		}
+		e.migration = true
+		e.expected = make(map[uint64]netip.AddrPort)
+	}
+}
+
+// WithSourceRateLimit returns an option to reject incoming datagrams from any
+// remote address that sends more than the given number per second, allowing a
+// burst of up to one second's worth. Rejected datagrams are reported with
+// RejectRate. A limiter is kept for each remote address, up to the
+// WithAddressLimit, after which the least recently used is dropped and its
+// address starts again with a full burst.
+func WithSourceRateLimit(perSecond int) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.sourceRate = perSecond
+		e.sources = make(map[netip.AddrPort]*source)
+	}
+}
+
+// WithPooledRead returns an option for Reader.Read to return slices taken from
+// a pool, rather than allocating a new slice each time. The caller should
+// return each slice with Endpoint.Release once it is no longer needed, and must
+// not retain the slice after that.
+func WithPooledRead() func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.pooledRead = true
+	}
+}
+
+// WithPortAssigned returns an option to call the function with the bound port
+// once the socket is open, which is useful when binding to port 0.
+func WithPortAssigned(fn func(int)) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.onPort = fn
+	}
+}
+
+// WithReceiveOnly returns an option for an end point that never sends, which
+// saves creating the pool of writers. Writes to any writer from the end point,
+// and Send or SendBytes, then return ErrReceiveOnly.
+func WithReceiveOnly() func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.receiveOnly = true
+	}
+}
+
+// WithSendOnly returns an option for an end point that never receives, which
+// saves allocating the zero filled buffer used to receive. Receive and the
+// other receive methods then return ErrSendOnly.
+func WithSendOnly() func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.sendOnly = true
+	}
+}
+
+// WithRawRead returns an option for received payloads to be delivered without
+// checking or consuming the protocol header, for example for inspection tools.
+// The reader then starts at the header, which can be read with
+// Reader.RawHeader. Any padding or checksum is left in place.
+func WithRawRead() func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.rawRead = true
+	}
+}
+
+// WithArena returns an option to make the payload buffers of the end point from
+// slabs of n buffers at a time, rather than allocating each one separately. This
+// helps receivers that hold many readers at once, where the pool is often empty.
+// Buffers are still returned to the pool when a reader is closed, or a writer is
+// sent.
+func WithArena(n int) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.arena = n
+	}
+}
+
+// WithDontFragment returns an option to set the don't fragment bit on sent
+// datagrams, so that a payload larger than the path MTU fails with a
+// MessageTooLargeError rather than being fragmented. This is only supported on
+// Linux and has no effect elsewhere.
+func WithDontFragment() func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.dontFragment = true
+	}
+}
+
+// WithReaderRing returns an option to make a ring of n readers for use by
+// ReceiveRing.
+func WithReaderRing(n int) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.ring = &ReaderRing{readers: make([]Reader, n), used: make([]atomic.Bool, n)}
+	}
+}
+
+// WithPacing returns an option to space consecutive sends by at least the gap,
+// to smooth out bursts. A send waits for its turn, unless that would take
+// longer than its timeout, when ErrRateLimited is returned. This can be used
+// with or without WithRateLimit.
+func WithPacing(gap time.Duration) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.gap = gap
+	}
+}
+
+// WithFEC returns an option for forward error correction, so that a lost
+// datagram can be recovered without retransmission. The datagrams sent to each
+// address are taken in groups of data, each group being followed by parity
+// recovery datagrams holding the XOR of the group. The receiver rebuilds one
+// missing datagram per group when a parity datagram arrives, and Receive then
+// returns it in place of the parity datagram; parity beyond one only guards
+// against the parity datagrams themselves being lost. Both end points must use
+// the same option, which leaves eight bytes less for each writer,
+// and the group sizes must be from 1 to 255.
+//
+// Parity is only sent once a group is complete, so the datagrams of a group
+// that is never completed, such as the last one sent, cannot be recovered.
+// Late datagrams, and those already rebuilt from the parity, are dropped. The
+// state kept for each address is bounded by WithAddressLimit.
+func WithFEC(data, parity int) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.fec = &fec{
+			data:   data,
+			parity: parity,
+			out:    make(map[netip.AddrPort]*fecSender),
+			in:     make(map[netip.AddrPort]*fecReceiver),
+		}
+	}
+}
+
+// WithReceiveFilter returns an option to call the function with the raw bytes
+// and source of every received datagram, before anything else is done with it.
+// If the function returns false the datagram is dropped and Receive returns a
+// nil reader, as for a rejected datagram but without calling WithOnReject. The
+// bytes must not be retained or changed.
+func WithReceiveFilter(fn func(raw []byte, addr *net.UDPAddr) bool) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.filter = fn
+	}
+}
+
+// WithLogger returns an option to log events with the logger: each payload
+// sent or received at the debug level, and rejected datagrams and errors at the
+// warn level. Records have attributes such as LogRemote and LogSeq. Timeouts are
+// not logged. Without a logger there is no logging.
+func WithLogger(logger *slog.Logger) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.logger = logger
+	}
+}
+
+// WithCaptureBatch returns an option for each CaptureBatch returned by
+// Capture to hold up to n datagrams, rather than DefaultCaptureBatch. Each
+// batch keeps an arena of n payloads, and the first call to Capture makes as
+// many batches as the pool capacity, so the memory used is the pool capacity
+// times n times the payload size.
+func WithCaptureBatch(n int) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.capture = n
+	}
+}
+
+// WithAddressLimit returns an option to keep state for at most n remote
+// addresses, rather than DefaultAddressLimit, so that datagrams from many, or
+// spoofed, sources cannot use memory without limit. Once the limit is reached
+// the state of an address that has not been used recently is dropped to make
+// room for a new one.
+func WithAddressLimit(n int) func(*Endpoint) {
+	return func(e *Endpoint) {
+		e.addresses = n
+	}
+}
@@ -2,6 +2,7 @@ package datagram
 
 import (
 	"errors"
+	"net"
 	"os"
 )
 
@@ -9,3 +10,9 @@ import (
 func IsTimeout(err error) bool {
 	return err != nil && errors.Is(err, os.ErrDeadlineExceeded)
 }
+
+// IsClosed returns true if the network action failed because the end point is
+// closed.
+func IsClosed(err error) bool {
+	return err != nil && errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,190 @@
+package datagram
+
+import (
+	"math/bits"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// A peer tracks the sequence numbers received from one remote address.
+type peer struct {
+	first    uint64 // The first sequence number received.
+	last     uint64 // The highest sequence number received.
+	window   uint64 // Bit i is set if sequence last-i has been received.
+	received uint64 // The datagrams received, including duplicates.
+	used     uint64 // The tick when last used.
+}
+
+// migrationMinimum is the number of datagrams a peer must have sent before it
+// is an established stream that can migrate to another address.
+const migrationMinimum = 3
+
+// observe records the sequence number and returns true if it has already been
+// received. Sequence numbers too old to be in the window are never reported as
+// duplicates.
+func (p *peer) observe(seq uint64) (duplicate bool) {
+	p.received++
+	switch {
+	case seq > p.last:
+		if shift := seq - p.last; shift < 64 {
+			p.window <<= shift
+		} else {
+			p.window = 0
+		}
+		p.window |= 1
+		p.last = seq
+	case p.last-seq < 64:
+		bit := uint64(1) << (p.last - seq)
+		duplicate = p.window&bit != 0
+		p.window |= bit
+	}
+	return
+}
+
+// The tracking status of a received datagram.
+type tracking uint8
+
+const (
+	trackedDuplicate tracking = 1 << iota
+	trackedMigrated
+)
+
+// addrPort returns the address as a comparable key, with IPv4 addresses
+// received on a dual stack socket unmapped.
+func addrPort(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+func (e *Endpoint) track(addr *net.UDPAddr, seq uint64) (status tracking) {
+	key := addrPort(addr)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	p, ok := e.peers[key]
+	if !ok && e.migration {
+		if p = e.migrate(key, seq); p != nil {
+			status |= trackedMigrated
+			ok = true
+		}
+	}
+	e.tick++
+	if !ok {
+		if len(e.peers) >= e.addresses {
+			old, q := evict(e.peers, func(p *peer) uint64 { return p.used })
+			e.unexpect(old, q.last)
+		}
+		e.peers[key] = &peer{first: seq, last: seq, window: 1, received: 1, used: e.tick}
+		return
+	}
+	p.used = e.tick
+	last := p.last
+	if p.observe(seq) {
+		status |= trackedDuplicate
+	}
+	if e.migration && p.received >= migrationMinimum {
+		if p.last != last {
+			e.unexpect(key, last)
+		}
+		e.expect(key, p.last+1)
+	}
+	return
+}
+
+// expect indexes the established peer at the address by the sequence number
+// expected next from it, for migrate. If another peer expects the same number
+// the index is left ambiguous, as an invalid address. The lock must be held.
+func (e *Endpoint) expect(key netip.AddrPort, next uint64) {
+	if k, ok := e.expected[next]; ok && k != key {
+		e.expected[next] = netip.AddrPort{}
+		return
+	}
+	e.expected[next] = key
+}
+
+// unexpect removes the index of the peer at the address, or an ambiguous one,
+// given its last sequence number. The lock must be held.
+func (e *Endpoint) unexpect(key netip.AddrPort, last uint64) {
+	if k, ok := e.expected[last+1]; ok && (k == key || !k.IsValid()) {
+		delete(e.expected, last+1)
+	}
+}
+
+// migrate looks up the one established peer whose sequence is continued by seq
+// and moves it to the new address. The lock must be held.
+func (e *Endpoint) migrate(key netip.AddrPort, seq uint64) *peer {
+	from, ok := e.expected[seq]
+	if !ok || !from.IsValid() {
+		return nil // None, or ambiguous.
+	}
+	p := e.peers[from]
+	if p == nil || p.last+1 != seq || p.received < migrationMinimum {
+		delete(e.expected, seq)
+		return nil
+	}
+	delete(e.peers, from)
+	e.peers[key] = p
+	e.expected[seq] = key
+	return p
+}
+
+// ReceiveDedup is the same as Receive but also reports whether the sequence
+// number has already been received from the same remote address, such as when
+// a datagram is retransmitted. This requires a Sequenced protocol and the
+// WithPeerTracking option, otherwise duplicate is always false.
+func (e *Endpoint) ReceiveDedup(timeout time.Duration) (reader *Reader, addr *net.UDPAddr, seq uint64, duplicate bool, err error) {
+	var status tracking
+	reader, addr, seq, status, err = e.receive(timeout, nil)
+	duplicate = status&trackedDuplicate != 0
+	return
+}
+
+// ReceiveMigrated is the same as Receive but also reports whether the remote
+// address has changed during an established sequence. This requires a
+// Sequenced protocol and the WithMigration option: when a datagram arrives from
+// an unknown address and its sequence number follows on from exactly one peer
+// that has sent at least three datagrams, that peer is taken to have moved to
+// the new address.
+func (e *Endpoint) ReceiveMigrated(timeout time.Duration) (reader *Reader, addr *net.UDPAddr, seq uint64, migrated bool, err error) {
+	var status tracking
+	reader, addr, seq, status, err = e.receive(timeout, nil)
+	migrated = status&trackedMigrated != 0
+	return
+}
+
+// RangePeers calls the function for each remote address tracked with the
+// WithPeerTracking option, with the highest sequence number received from it,
+// until the function returns false. The function must not call back into the
+// end point, since the tracking lock is held.
+func (e *Endpoint) RangePeers(fn func(addr netip.AddrPort, lastSeq uint64) bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for k, p := range e.peers {
+		if !fn(k, p.last) {
+			return
+		}
+	}
+}
+
+// LossRate returns the fraction of sequence numbers not received from the
+// remote address over the window of the last 64, or since the first received
+// if that is more recent. This requires a Sequenced protocol and the
+// WithPeerTracking option, otherwise, or if the address is unknown, the rate is
+// zero. Datagrams that arrive out of order are only counted as lost until they
+// arrive.
+func (e *Endpoint) LossRate(addr netip.AddrPort) float64 {
+	key := netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	p, ok := e.peers[key]
+	if !ok {
+		return 0
+	}
+	window := p.window
+	expected := uint64(64)
+	if span := p.last - p.first; span < 63 {
+		expected = span + 1
+		window &= 1<<expected - 1
+	}
+	return 1 - float64(bits.OnesCount64(window))/float64(expected)
+}
@@ -1,5 +1,13 @@
 package datagram
 
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"time"
+)
+
 // A Protocol defines how to communicate over UDP. The hash is used in the
 // payload header to filter out 'stranger' UDP datagrams. A non-zero hash will
 // cause the protocol to be written first into every sent payload and read first
@@ -9,36 +17,329 @@ package datagram
 //
 //	h := maphash.String(maphash.MakeSeed(), "my-protocol/v1")
 //
+// Since maphash seeds differ between processes, a HashString can be given
+// instead of the hash. The end point then derives the hash from the string with
+// FNV-1a, so that independently started processes agree on it.
+//
 // The payload is the maximum data size expected with the protocol. Note
 // the constant MaxPayload in this package.
+//
+// A codec, if given, replaces the built in hash and sequence header.
+//
+// A non-zero PadTo pads every sent payload with zero bytes to that size, so that
+// all datagrams have the same length on the wire. A two byte length field is
+// then added to the header so that the padding can be ignored when received.
+//
+// A true Checksum adds a checksum of the body to the end of every sent payload,
+// and received payloads that do not match are rejected. ChecksumHeaders does the
+// same but the checksum covers the whole payload, including the header, so that
+// changes to the header are also detected. The ChecksumAlgorithm selects the
+// checksum used.
+//
+// FrameLengthBytes is the width of the length field used by Writer.Write and
+// Reader.Read, which can be 1, 2 or 4 bytes. The default is 2.
+//
+// A true Timestamped adds the time the payload is sent to the header, as eight
+// bytes of Unix nanoseconds after any sequence number, and cannot be used with
+// a Codec. A non-zero ClockSkew then
+// rejects received payloads whose time is further than that from the clock of
+// the receiver, which resists replay without tracking sequence numbers. The
+// clocks of the end points must agree to within the skew.
+//
+// A true RejectZeroSequence makes Receive reject, with RejectSequence, a
+// Sequenced datagram with the sequence number zero, since the first number sent
+// by an end point is one and zero can only come from an uninitialised sender.
 type Protocol struct {
-	Hash      uint64
-	Sequenced bool
-	Payload   uint16
+	Hash               uint64
+	HashString         string
+	Sequenced          bool
+	Payload            uint16
+	Codec              HeaderCodec
+	PadTo              uint16
+	Checksum           bool
+	ChecksumHeaders    bool
+	ChecksumAlgorithm  ChecksumAlgorithm
+	FrameLengthBytes   int
+	RejectZeroSequence bool
+	Timestamped        bool
+	ClockSkew          time.Duration
+}
+
+// Equal returns true if the other protocol has the same configuration, field by
+// field, for example to decide whether end points need to be made again after
+// reloading the configuration. Codecs are equal if they are the same value,
+// such as the same pointer, and never if their type cannot be compared.
+func (p *Protocol) Equal(other *Protocol) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	return p.Hash == other.Hash &&
+		p.HashString == other.HashString &&
+		p.Sequenced == other.Sequenced &&
+		p.Payload == other.Payload &&
+		sameCodec(p.Codec, other.Codec) &&
+		p.PadTo == other.PadTo &&
+		p.Checksum == other.Checksum &&
+		p.ChecksumHeaders == other.ChecksumHeaders &&
+		p.ChecksumAlgorithm == other.ChecksumAlgorithm &&
+		p.FrameLengthBytes == other.FrameLengthBytes &&
+		p.RejectZeroSequence == other.RejectZeroSequence &&
+		p.Timestamped == other.Timestamped &&
+		p.ClockSkew == other.ClockSkew
+}
+
+// sameCodec compares the codecs without panicking on an uncomparable type.
+func sameCodec(a, b HeaderCodec) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ta := reflect.TypeOf(a)
+	if ta != reflect.TypeOf(b) {
+		return false
+	}
+	return ta.Comparable() && a == b
+}
+
+// hashed returns true if the protocol has a hash in the header.
+func (p *Protocol) hashed() bool {
+	return p.Hash > 0 || p.HashString != ""
+}
+
+// hash returns the protocol hash, derived from the HashString if there is one.
+func (p *Protocol) hash() uint64 {
+	if p.HashString == "" {
+		return p.Hash
+	}
+	h := fnv.New64a()
+	h.Write([]byte(p.HashString))
+	return h.Sum64()
+}
+
+// Fits returns true if a body of the given length, plus the protocol header and
+// any checksum, fits within the payload.
+func (p *Protocol) Fits(bodyLen int) bool {
+	limit := int(p.Payload)
+	if p.PadTo > 0 {
+		limit = int(p.PadTo)
+	}
+	return bodyLen >= 0 && p.headerSize()+bodyLen+p.trailerSize() <= limit
+}
+
+// headerSize returns the number of bytes in the protocol header.
+func (p *Protocol) headerSize() (n int) {
+	switch {
+	case p.Codec != nil:
+		n = p.Codec.Size()
+	default:
+		if p.hashed() {
+			n += 8
+		}
+		if p.Sequenced {
+			n += 8
+		}
+		if p.Timestamped {
+			n += 8
+		}
+	}
+	if p.PadTo > 0 {
+		n += 2
+	}
+	return
 }
 
-func protocolWrite(protocol *Protocol, writer *Writer) error {
-	return writer.WriteUint64(protocol.Hash)
+// frameLengthBytes returns the width of the Write length field.
+func (p *Protocol) frameLengthBytes() int {
+	if p.FrameLengthBytes == 0 {
+		return 2
+	}
+	return p.FrameLengthBytes
+}
+
+// maxFrameLength returns the largest length that fits a field of the width,
+// and an int on 32 bit platforms.
+func maxFrameLength(width int) int {
+	if width >= 4 {
+		return math.MaxInt32
+	}
+	return 1<<(8*width) - 1
+}
+
+// putFrameLength writes the length into the field, which is 1, 2 or 4 bytes.
+func putFrameLength(b []byte, length int) {
+	switch len(b) {
+	case 1:
+		b[0] = uint8(length)
+	case 2:
+		binary.BigEndian.PutUint16(b, uint16(length))
+	default:
+		binary.BigEndian.PutUint32(b, uint32(length))
+	}
+}
+
+// frameLength reads the length from the field, which is 1, 2 or 4 bytes.
+func frameLength(b []byte) int {
+	switch len(b) {
+	case 1:
+		return int(b[0])
+	case 2:
+		return int(binary.BigEndian.Uint16(b))
+	default:
+		return int(binary.BigEndian.Uint32(b))
+	}
 }
 
-func protocolRead(protocol *Protocol, reader *Reader) (ok bool, err error) {
+// trailerSize returns the number of bytes after the body, which is the checksum.
+func (p *Protocol) trailerSize() int {
+	if p.checksummed() {
+		return p.checksumSize()
+	}
+	return 0
+}
+
+// A HeaderCodec writes and reads a custom payload header. Write is called for
+// every new writer, and can use Endpoint.NextSequence for sequencing. Read is
+// called for every received payload and returns false if the payload is to be
+// rejected, otherwise the sequence number of the payload. Size returns the
+// number of bytes in the header.
+type HeaderCodec interface {
+	Write(writer *Writer, endpoint *Endpoint) error
+	Read(reader *Reader, endpoint *Endpoint) (ok bool, seq uint64, err error)
+	Size() int
+}
+
+func headerWrite(endpoint *Endpoint, writer *Writer) (err error) {
+	if codec := endpoint.protocol.Codec; codec != nil {
+		err = codec.Write(writer, endpoint)
+	} else {
+		if endpoint.protocol.hashed() {
+			if err = protocolWrite(endpoint, writer); err != nil {
+				return
+			}
+		}
+		if endpoint.protocol.Sequenced {
+			if err = sequenceWrite(endpoint, writer); err != nil {
+				return
+			}
+		}
+		if endpoint.protocol.Timestamped {
+			err = writer.WriteInt64(0) // Set by timestampWrite.
+		}
+	}
+	if err == nil && endpoint.protocol.PadTo > 0 {
+		err = writer.WriteUint16(0) // Body length, set by padWrite.
+	}
+	return
+}
+
+// headerRead returns a non-empty reason if the payload is to be rejected.
+func headerRead(endpoint *Endpoint, reader *Reader) (seq uint64, reason string, err error) {
+	if codec := endpoint.protocol.Codec; codec != nil {
+		var ok bool
+		if ok, seq, err = codec.Read(reader, endpoint); err != nil {
+			return
+		}
+		if !ok {
+			reason = RejectHeader
+			return
+		}
+	} else {
+		if endpoint.protocol.hashed() {
+			var ok bool
+			if ok, err = protocolRead(endpoint, reader); err != nil || !ok {
+				reason = RejectHash
+				return
+			}
+		}
+		if endpoint.protocol.Sequenced {
+			if seq, reason, err = sequenceRead(endpoint, reader); err != nil || reason != "" {
+				return
+			}
+		}
+		if endpoint.protocol.Timestamped {
+			if reason, err = timestampRead(endpoint, reader); err != nil || reason != "" {
+				return
+			}
+		}
+	}
+	if endpoint.protocol.PadTo > 0 {
+		reason = padRead(reader)
+	}
+	return
+}
+
+// padWrite sets the body length in the header and pads the payload.
+func padWrite(endpoint *Endpoint, writer *Writer) {
+	b := writer.buffer.Bytes()
+	binary.BigEndian.PutUint16(b[writer.header-2:], uint16(len(b)-writer.header))
+	if pad := int(endpoint.protocol.PadTo) - endpoint.protocol.trailerSize() - len(b); pad > 0 {
+		writer.buffer.Write(endpoint.zero[:pad])
+	}
+}
+
+// padRead reads the body length from the header and discards the padding.
+func padRead(reader *Reader) (reason string) {
+	length, err := reader.ReadUint16()
+	if err != nil || int(length) > reader.Remaining() {
+		return RejectPadding
+	}
+	reader.buffer.Truncate(int(length))
+	return
+}
+
+func protocolWrite(endpoint *Endpoint, writer *Writer) error {
+	return writer.WriteUint64(endpoint.hash)
+}
+
+func protocolRead(endpoint *Endpoint, reader *Reader) (ok bool, err error) {
+	if reader.Remaining() < 8 {
+		return // Too short to be one of ours.
+	}
 	var hash uint64
 	hash, err = reader.ReadUint64()
 	if err != nil {
 		return
 	}
-	if hash != protocol.Hash {
+	if hash != endpoint.hash {
 		return
 	}
 	ok = true
 	return
 }
 
+// timestampWrite sets the time in the header to now, as the payload is sent.
+func timestampWrite(endpoint *Endpoint, writer *Writer) {
+	offset := 0
+	if endpoint.protocol.hashed() {
+		offset += 8
+	}
+	if endpoint.protocol.Sequenced {
+		offset += 8
+	}
+	binary.BigEndian.PutUint64(writer.buffer.Bytes()[offset:], uint64(time.Now().UnixNano()))
+}
+
+// timestampRead reads the time from the header and rejects it if it is outside
+// the clock skew.
+func timestampRead(endpoint *Endpoint, reader *Reader) (reason string, err error) {
+	var nanos int64
+	if nanos, err = reader.ReadInt64(); err != nil {
+		return
+	}
+	if skew := endpoint.protocol.ClockSkew; skew > 0 {
+		if d := time.Since(time.Unix(0, nanos)); d > skew || d < -skew {
+			reason = RejectStale
+		}
+	}
+	return
+}
+
 func sequenceWrite(endpoint *Endpoint, writer *Writer) error {
-	endpoint.incr()
-	return writer.WriteUint64(endpoint.LastSequence())
+	return writer.WriteUint64(endpoint.NextSequence())
 }
 
-func sequenceRead(endpoint *Endpoint, reader *Reader) (seq uint64, err error) {
-	return reader.ReadUint64()
+func sequenceRead(endpoint *Endpoint, reader *Reader) (seq uint64, reason string, err error) {
+	if seq, err = reader.ReadUint64(); err == nil && seq == 0 && endpoint.protocol.RejectZeroSequence {
+		reason = RejectSequence
+	}
+	return
 }
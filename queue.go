@@ -0,0 +1,75 @@
+package datagram
+
+import (
+	"container/heap"
+	"net"
+	"time"
+)
+
+// A queued payload waiting for FlushQueue.
+type queued struct {
+	writer   *Writer
+	address  *net.UDPAddr
+	priority int
+	order    uint64 // Keeps payloads of equal priority in the order queued.
+}
+
+// A sendQueue is a heap of queued payloads, highest priority first.
+type sendQueue []queued
+
+func (q sendQueue) Len() int { return len(q) }
+
+func (q sendQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].order < q[j].order
+}
+
+func (q sendQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *sendQueue) Push(x any) { *q = append(*q, x.(queued)) }
+
+func (q *sendQueue) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	old[len(old)-1] = queued{}
+	*q = old[:len(old)-1]
+	return x
+}
+
+// SendQueuedPriority queues the UDP payload in the writer to be sent to the
+// address by FlushQueue. Payloads with a higher priority are sent first, and
+// those of equal priority in the order they were queued, so that control
+// messages can overtake bulk data. The writer should not be used again after
+// this call.
+func (e *Endpoint) SendQueuedPriority(writer *Writer, address *net.UDPAddr, priority int) error {
+	if err := writer.err; err != nil {
+		e.discard(writer)
+		return err
+	}
+	e.queueLock.Lock()
+	defer e.queueLock.Unlock()
+	e.queueOrder++
+	heap.Push(&e.queue, queued{writer: writer, address: address, priority: priority, order: e.queueOrder})
+	return nil
+}
+
+// FlushQueue sends every payload queued by SendQueuedPriority, in priority
+// order, each with the timeout. A payload queued during the flush is sent by it
+// if its turn comes. All are sent even if one fails, and the first error is
+// returned.
+func (e *Endpoint) FlushQueue(timeout time.Duration) (err error) {
+	for {
+		e.queueLock.Lock()
+		if e.queue.Len() == 0 {
+			e.queueLock.Unlock()
+			return
+		}
+		q := heap.Pop(&e.queue).(queued)
+		e.queueLock.Unlock()
+		if serr := e.Send(q.writer, q.address, timeout); err == nil {
+			err = serr
+		}
+	}
+}
@@ -3,26 +3,196 @@ package datagram
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 // A Reader provides methods to read a UDP payload.
 type Reader struct {
 	buffer   *bytes.Buffer
 	endpoint *Endpoint
+	length   int          // The length of the datagram when received.
+	body     int          // The unread length at the start of the body.
+	fields   int          // The number of fields read from the body.
+	expect   int          // The number of fields expected, if positive.
+	clone    bool         // Set if the buffer belongs to another reader.
+	slot     *atomic.Bool // The in use flag of the ReaderRing slot, if any.
 }
 
-// ReadUint16 reads an uint64 from the payload.
+// Clone returns an independent reader over the remaining bytes of the payload.
+// The clone shares the underlying bytes with this reader, so it must not be
+// used after this reader is closed. Closing the clone does not affect this
+// reader.
+func (r *Reader) Clone() *Reader {
+	c := &Reader{
+		endpoint: r.endpoint,
+		length:   r.length,
+		body:     r.body,
+		clone:    true,
+	}
+	if r.buffer != nil {
+		c.buffer = bytes.NewBuffer(r.buffer.Bytes())
+	}
+	return c
+}
+
+// DatagramLen returns the full length of the received UDP datagram, including
+// any protocol headers. This does not change as the payload is read.
+func (r *Reader) DatagramLen() int {
+	return r.length
+}
+
+// Remaining returns the number of unread bytes in the payload.
+func (r *Reader) Remaining() int {
+	if r.buffer == nil {
+		return 0
+	}
+	return r.buffer.Len()
+}
+
+// RawHeader reads the protocol hash and sequence number from the start of a
+// payload received by an end point made WithRawRead. Each is zero if the
+// protocol does not have it. This does not apply to a protocol with a Codec.
+func (r *Reader) RawHeader() (hash uint64, seq uint64, err error) {
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	protocol := r.endpoint.protocol
+	if protocol.hashed() {
+		if hash, err = r.ReadUint64(); err != nil {
+			return
+		}
+	}
+	if protocol.Sequenced {
+		seq, err = r.ReadUint64()
+	}
+	return
+}
+
+// HeaderAndBody returns the protocol header and then the rest of the unread
+// payload as separate slices over the buffer, for a reader from an end point
+// made WithRawRead. The header is HeaderSize bytes and the body includes any
+// padding and checksum. Nothing is consumed, and the slices are only valid
+// until the reader is closed. ErrNotRawRead is returned for other readers, and
+// ErrInvalidLength if the payload is shorter than the header.
+func (r *Reader) HeaderAndBody() (header []byte, body []byte, err error) {
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	if !r.endpoint.rawRead {
+		err = ErrNotRawRead
+		return
+	}
+	b := r.buffer.Bytes()
+	n := r.endpoint.protocol.headerSize()
+	if len(b) < n {
+		err = ErrInvalidLength
+		return
+	}
+	return b[:n:n], b[n:], nil
+}
+
+// Skip discards the next n bytes of the payload.
+func (r *Reader) Skip(n int) error {
+	if r.buffer == nil {
+		return ErrClosedReader
+	}
+	if n < 0 {
+		return ErrInvalidLength
+	}
+	if n > r.buffer.Len() {
+		return io.ErrUnexpectedEOF
+	}
+	r.buffer.Next(n)
+	return nil
+}
+
+// AlignTo skips the padding written by Writer.AlignTo, so that the next field
+// is read from an offset in the body that is a multiple of the boundary.
+func (r *Reader) AlignTo(boundary int) error {
+	if r.buffer == nil {
+		return ErrClosedReader
+	}
+	if boundary < 1 {
+		return ErrInvalidLength
+	}
+	return r.Skip(alignment(r.body-r.buffer.Len(), boundary))
+}
+
+// AssertEmpty returns ErrTrailingData if any of the payload remains unread, for
+// example to detect a message from a newer version with extra fields.
+func (r *Reader) AssertEmpty() error {
+	if r.buffer == nil {
+		return ErrClosedReader
+	}
+	if r.buffer.Len() > 0 {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+// ExpectFields records the number of fields that the body should contain, for
+// example from a field count in the message, to be checked by AssertFieldCount.
+func (r *Reader) ExpectFields(n int) {
+	r.expect = n
+}
+
+// FieldsRead returns the number of fields read from the body so far, counting
+// each successful call of a Read method.
+func (r *Reader) FieldsRead() int {
+	return r.fields
+}
+
+// AssertFieldCount returns ErrFieldCount if the number of fields read is not
+// that given to ExpectFields, which catches a reader and writer that disagree
+// about the schema. There is no error if no count is expected.
+func (r *Reader) AssertFieldCount() error {
+	if r.expect > 0 && r.fields != r.expect {
+		return ErrFieldCount
+	}
+	return nil
+}
+
+// count adds a field read, if there is no error.
+func (r *Reader) count(err *error) {
+	if *err == nil {
+		r.fields++
+	}
+}
+
+// ReadUint8 reads an uint8 from the payload.
+func (r *Reader) ReadUint8() (v uint8, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	return r.buffer.ReadByte()
+}
+
+// ReadUint16 reads an uint16 from the payload.
 func (r *Reader) ReadUint16() (v uint16, err error) {
+	defer r.count(&err)
 	if r.buffer == nil {
 		err = ErrClosedReader
 		return
 	}
-	err = binary.Read(r.buffer, binary.BigEndian, &v)
+	if r.buffer.Len() < 2 {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	v = binary.BigEndian.Uint16(r.buffer.Next(2))
 	return
 }
 
 // ReadUint64 reads an uint64 from the payload.
 func (r *Reader) ReadUint64() (v uint64, err error) {
+	defer r.count(&err)
 	if r.buffer == nil {
 		err = ErrClosedReader
 		return
@@ -33,6 +203,7 @@ func (r *Reader) ReadUint64() (v uint64, err error) {
 
 // ReadInt64 reads an int64 from the payload.
 func (r *Reader) ReadInt64() (v int64, err error) {
+	defer r.count(&err)
 	if r.buffer == nil {
 		err = ErrClosedReader
 		return
@@ -43,6 +214,7 @@ func (r *Reader) ReadInt64() (v int64, err error) {
 
 // ReadFloat64 reads a float64 from the payload.
 func (r *Reader) ReadFloat64() (v float64, err error) {
+	defer r.count(&err)
 	if r.buffer == nil {
 		err = ErrClosedReader
 		return
@@ -51,22 +223,483 @@ func (r *Reader) ReadFloat64() (v float64, err error) {
 	return
 }
 
+// ReadDecimal reads a fixed-point value written by WriteDecimal.
+func (r *Reader) ReadDecimal() (mantissa int64, scale int8, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	if r.buffer.Len() < 9 {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	b := r.buffer.Next(9)
+	mantissa = int64(binary.BigEndian.Uint64(b))
+	scale = int8(b[8])
+	return
+}
+
+// ReadFloat64Delta reads a difference written by WriteFloat64Delta and adds it
+// to the previous value.
+func (r *Reader) ReadFloat64Delta(prev float64) (v float64, err error) {
+	if v, err = r.ReadFloat64(); err != nil {
+		return
+	}
+	v += prev
+	return
+}
+
+// ReadZigzag reads a zigzag encoded varint from the payload.
+func (r *Reader) ReadZigzag() (v int64, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	if v, err = binary.ReadVarint(r.buffer); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// ReadUnixSeconds reads a time written by WriteUnixSeconds.
+func (r *Reader) ReadUnixSeconds() (v time.Time, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	if r.buffer.Len() < 4 {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	v = time.Unix(int64(binary.BigEndian.Uint32(r.buffer.Next(4))), 0)
+	return
+}
+
+// ReadUUID reads a UUID written by WriteUUID.
+func (r *Reader) ReadUUID() (u [16]byte, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	if r.buffer.Len() < len(u) {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	copy(u[:], r.buffer.Next(len(u)))
+	return
+}
+
+// ReadRepeated reads a run written by WriteRepeated.
+func (r *Reader) ReadRepeated() (b byte, count int, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	if b, err = r.buffer.ReadByte(); err != nil {
+		return
+	}
+	var v uint64
+	if v, err = binary.ReadUvarint(r.buffer); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if v > math.MaxInt {
+		err = ErrOverflow
+		return
+	}
+	count = int(v)
+	return
+}
+
+// ReadSendTime reads a time written by WriteSendTime.
+func (r *Reader) ReadSendTime() (v time.Time, err error) {
+	var nanos int64
+	if nanos, err = r.ReadInt64(); err != nil {
+		return
+	}
+	v = time.Unix(0, nanos)
+	return
+}
+
+// OneWayDelay reads a time written by WriteSendTime and returns the time since
+// then. This is only meaningful if the clocks of the sender and receiver are
+// synchronised.
+func OneWayDelay(r *Reader) (time.Duration, error) {
+	sent, err := r.ReadSendTime()
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(sent), nil
+}
+
+// ReadBitSet reads n bits written by WriteBitSet.
+func (r *Reader) ReadBitSet(n int) (bits uint64, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	if n < 0 || n > 64 {
+		err = ErrInvalidLength
+		return
+	}
+	size := (n + 7) / 8
+	if size > r.buffer.Len() {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	for _, b := range r.buffer.Next(size) {
+		bits = bits<<8 | uint64(b)
+	}
+	return
+}
+
+// ReadTLV reads a tag-length-value record written by WriteTLV.
+func (r *Reader) ReadTLV() (tag uint16, value []byte, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	if r.buffer.Len() < 4 {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	b := r.buffer.Next(4)
+	tag = binary.BigEndian.Uint16(b)
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length > r.buffer.Len() {
+		err = ErrOverflow
+		return
+	}
+	value = make([]byte, length)
+	copy(value, r.buffer.Next(length))
+	return
+}
+
 // Read a byte slice from the payload.
 func (r *Reader) Read() (v []byte, err error) {
+	defer r.count(&err)
 	if r.buffer == nil {
 		err = ErrClosedReader
 		return
 	}
-	var length uint16
-	if err = binary.Read(r.buffer, binary.BigEndian, &length); err != nil {
+	width := r.endpoint.protocol.frameLengthBytes()
+	if r.buffer.Len() < width {
+		err = io.ErrUnexpectedEOF
 		return
 	}
-	if length > MaxPayload {
+	length := frameLength(r.buffer.Next(width))
+	if length > r.buffer.Len() {
+		err = ErrOverflow
+		return
+	}
+	//
+	// A reassembled reader may hold frames larger than the pooled slices.
+	//
+	if r.endpoint.slices != nil && length <= r.endpoint.payload {
+		v = r.endpoint.slices.Next()[:length]
+	} else {
+		v = make([]byte, length)
+	}
+	copy(v, r.buffer.Next(length))
+	return
+}
+
+// ReadStringSlice reads the strings written by WriteStringSlice. Nothing is
+// consumed if there is an error.
+func (r *Reader) ReadStringSlice() (ss []string, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	if r.buffer.Len() < 2 {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	count := int(binary.BigEndian.Uint16(r.buffer.Bytes()))
+	//
+	// Each string takes at least its length field.
+	//
+	width := r.endpoint.protocol.frameLengthBytes()
+	if count*width > r.buffer.Len()-2 {
+		err = ErrOverflow
+		return
+	}
+	//
+	// Check every length before consuming anything.
+	//
+	b := r.buffer.Bytes()[2:]
+	for i := 0; i < count; i++ {
+		if len(b) < width {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		length := frameLength(b[:width])
+		if length > len(b)-width {
+			err = ErrOverflow
+			return
+		}
+		b = b[width+length:]
+	}
+	r.buffer.Next(2)
+	ss = make([]string, count)
+	for i := range ss {
+		ss[i] = string(r.buffer.Next(frameLength(r.buffer.Next(width))))
+	}
+	return
+}
+
+// ReadFrameNoCopy reads a byte slice written by Writer.Write, as Read, but
+// returns a slice of the payload rather than a copy. The slice must not be
+// changed, and is invalid once the reader is closed.
+func (r *Reader) ReadFrameNoCopy() (v []byte, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	width := r.endpoint.protocol.frameLengthBytes()
+	if r.buffer.Len() < width {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	length := frameLength(r.buffer.Next(width))
+	if length > r.buffer.Len() {
+		err = ErrOverflow
+		return
+	}
+	v = r.buffer.Next(length)
+	return
+}
+
+// PeekFrameLen returns the length of the next byte slice written by
+// Writer.Write without reading it, so that the caller can size a destination
+// or skip the frame. ErrOverflow is returned if the frame runs past the end of
+// the payload.
+func (r *Reader) PeekFrameLen() (length int, err error) {
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	width := r.endpoint.protocol.frameLengthBytes()
+	b := r.buffer.Bytes()
+	if len(b) < width {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	if length = frameLength(b[:width]); length > len(b)-width {
+		length, err = 0, ErrOverflow
+	}
+	return
+}
+
+// ReadVarBytes reads a byte slice preceded by its length as a uvarint, as
+// written by WriteVarBytes.
+func (r *Reader) ReadVarBytes() (v []byte, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	var length uint64
+	if length, err = binary.ReadUvarint(r.buffer); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if length > uint64(r.buffer.Len()) {
 		err = ErrOverflow
 		return
 	}
 	v = make([]byte, length)
-	_, err = r.buffer.Read(v)
+	copy(v, r.buffer.Next(int(length)))
+	return
+}
+
+// ReadRuneString reads a string written by WriteRuneString. The error is
+// ErrInvalidLength if the number of runes does not match the prefix.
+func (r *Reader) ReadRuneString() (v string, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	if r.buffer.Len() < 4 {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	b := r.buffer.Next(4)
+	runes := int(binary.BigEndian.Uint16(b))
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length > r.buffer.Len() {
+		err = ErrOverflow
+		return
+	}
+	v = string(r.buffer.Next(length))
+	if utf8.RuneCountInString(v) != runes {
+		v = ""
+		err = ErrInvalidLength
+	}
+	return
+}
+
+// ReadUvarintCanonical reads a uvarint from the payload, returning
+// ErrNonCanonical if it is encoded with more bytes than necessary, which is
+// when the last byte is zero. Nothing is consumed if there is an error.
+func (r *Reader) ReadUvarintCanonical() (v uint64, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	b := r.buffer.Bytes()
+	v, n := binary.Uvarint(b)
+	switch {
+	case n == 0:
+		err = io.ErrUnexpectedEOF
+	case n < 0:
+		err = ErrOverflow
+	case n > 1 && b[n-1] == 0:
+		err = ErrNonCanonical
+	}
+	if err != nil {
+		v = 0
+		return
+	}
+	r.buffer.Next(n)
+	return
+}
+
+// ReadUvarintSlice reads the values written by WriteUvarintSlice.
+func (r *Reader) ReadUvarintSlice() (vs []uint64, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	var count uint64
+	if count, err = binary.ReadUvarint(r.buffer); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	//
+	// Each value takes at least one byte.
+	//
+	if count > uint64(r.buffer.Len()) {
+		err = ErrOverflow
+		return
+	}
+	vs = make([]uint64, count)
+	for i := range vs {
+		if vs[i], err = binary.ReadUvarint(r.buffer); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			vs = nil
+			return
+		}
+	}
+	return
+}
+
+// ReadInt64Into reads the values written by WriteInt64Slice into the slice,
+// without allocating, and returns the number of values. The error is
+// io.ErrShortBuffer if the slice is too small for them all.
+func (r *Reader) ReadInt64Into(dst []int64) (n int, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	var count uint64
+	if count, err = binary.ReadUvarint(r.buffer); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if count > uint64(r.buffer.Len()/8) {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	if count > uint64(len(dst)) {
+		err = io.ErrShortBuffer
+		return
+	}
+	n = int(count)
+	for i := 0; i < n; i++ {
+		dst[i] = int64(binary.BigEndian.Uint64(r.buffer.Next(8)))
+	}
+	return
+}
+
+// ReadVarString reads a string preceded by its length as a uvarint, as written
+// by WriteVarString.
+func (r *Reader) ReadVarString() (v string, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	var length uint64
+	if length, err = binary.ReadUvarint(r.buffer); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if length > uint64(r.buffer.Len()) {
+		err = ErrOverflow
+		return
+	}
+	v = string(r.buffer.Next(int(length)))
+	return
+}
+
+// WriteTo writes the remaining bytes of the payload to w, without an
+// intermediate copy, and returns the number written. This implements
+// io.WriterTo, so io.Copy from a reader uses it.
+func (r *Reader) WriteTo(w io.Writer) (n int64, err error) {
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	return r.buffer.WriteTo(w)
+}
+
+// ReadAll reads all the remaining bytes of the payload.
+func (r *Reader) ReadAll() (v []byte, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	v = make([]byte, r.buffer.Len())
+	copy(v, r.buffer.Next(len(v)))
+	return
+}
+
+// ReadAllString reads all the remaining bytes of the payload as a string. The
+// bytes are copied, so the string remains valid after the reader is closed.
+func (r *Reader) ReadAllString() (v string, err error) {
+	defer r.count(&err)
+	if r.buffer == nil {
+		err = ErrClosedReader
+		return
+	}
+	v = string(r.buffer.Next(r.buffer.Len()))
 	return
 }
 
@@ -75,7 +708,17 @@ func (r *Reader) Close() error {
 	if r.buffer == nil {
 		return ErrClosedReader
 	}
-	r.endpoint.buffers.Recycle(r.buffer)
+	if !r.clone {
+		r.endpoint.buffers.Recycle(r.buffer)
+	}
 	r.buffer = nil
+	//
+	// Freeing the ring slot must come last, as ReceiveRing may then reuse
+	// the reader.
+	//
+	if slot := r.slot; slot != nil {
+		r.slot = nil
+		slot.Store(false)
+	}
 	return nil
 }
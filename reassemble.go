@@ -0,0 +1,38 @@
+package datagram
+
+import (
+	"bytes"
+)
+
+// Reassemble returns a single reader over the unread bytes of the fragments, in
+// order, so that a message split across several datagrams can be decoded with
+// the usual reader methods, including fields that straddle the fragments. The
+// fragments are closed. The returned reader must be closed after use.
+//
+// The package does not split messages itself: it is for the application to
+// receive the fragments and put them in order.
+func (e *Endpoint) Reassemble(fragments []*Reader) (*Reader, error) {
+	n := 0
+	for _, f := range fragments {
+		if f.buffer == nil {
+			return nil, ErrClosedReader
+		}
+		n += f.buffer.Len()
+	}
+	buffer := new(bytes.Buffer)
+	buffer.Grow(n)
+	for _, f := range fragments {
+		buffer.Write(f.buffer.Bytes())
+		f.Close()
+	}
+	//
+	// The buffer may be larger than any payload, so it is not put in the pool.
+	//
+	return &Reader{
+		buffer:   buffer,
+		endpoint: e,
+		length:   n,
+		body:     n,
+		clone:    true,
+	}, nil
+}
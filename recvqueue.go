@@ -0,0 +1,10 @@
+package datagram
+
+// RecvQueueLen returns the number of bytes waiting in the receive queue of the
+// socket, as reported by the SIOCINQ ioctl, to tell whether the receiver is
+// keeping up. For UDP the kernel reports the length of the next waiting
+// datagram rather than the whole queue, so zero means the queue is empty. This
+// is only supported on Linux, elsewhere ErrNotSupported is returned.
+func (e *Endpoint) RecvQueueLen() (int, error) {
+	return recvQueueLen(e.conn)
+}
@@ -0,0 +1,27 @@
+package datagram
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+func recvQueueLen(conn *net.UDPConn) (n int, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		var v int32
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCINQ, uintptr(unsafe.Pointer(&v)))
+		n = int(v)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return
+}
@@ -0,0 +1,36 @@
+package datagram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecvQueueLen(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	n, err := receiver.RecvQueueLen()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	for i := 0; i < 4; i++ {
+		w := sender.Writer()
+		w.WriteUint64(uint64(i))
+		assert.Nil(t, sender.Send(w, receiver.LocalAddress(), 20*time.Millisecond))
+	}
+	n, err = receiver.RecvQueueLen()
+	assert.Nil(t, err)
+	assert.Positive(t, n)
+	for i := 0; i < 4; i++ {
+		reader, _, _, err := receiver.Receive(time.Second)
+		assert.Nil(t, err)
+		reader.Close()
+	}
+	n, err = receiver.RecvQueueLen()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package datagram
+
+import (
+	"net"
+)
+
+func recvQueueLen(conn *net.UDPConn) (int, error) {
+	return 0, ErrNotSupported
+}
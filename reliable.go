@@ -0,0 +1,117 @@
+package datagram
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// AckType is the first byte of the body of an acknowledgment sent by
+// ReceiveAndAck, which is followed by the acknowledged sequence number as eight
+// bytes. Applications using SendReliable should not start their own bodies
+// with this byte.
+const AckType byte = 0xff
+
+// ackSize is the body length of an acknowledgment.
+const ackSize = 1 + 8
+
+// SendReliable sends the UDP payload in the writer and waits up to the timeout
+// for an acknowledgment of its sequence number from the address, as sent by
+// ReceiveAndAck. The same payload is sent again, up to the given number of
+// attempts in all, until it is acknowledged. ErrNotAcknowledged is returned if
+// every attempt times out. Other payloads received while waiting are
+// discarded. This requires a Sequenced protocol without a Codec, otherwise
+// ErrUnsequenced is returned. The writer should not be used again after this
+// call.
+func (e *Endpoint) SendReliable(writer *Writer, address *net.UDPAddr, timeout time.Duration, attempts int) (err error) {
+	defer e.discard(writer)
+	if writer.err != nil {
+		return writer.err
+	}
+	if !e.protocol.Sequenced || e.protocol.Codec != nil {
+		return ErrUnsequenced
+	}
+	seq, _ := e.payloadSequence(writer.buffer.Bytes())
+	if e.protocol.PadTo > 0 {
+		padWrite(e, writer)
+	}
+	n := writer.buffer.Len()
+	to := target{udp: address}
+	for i := 0; i < attempts; i++ {
+		//
+		// Each attempt is sent with the time it is sent.
+		//
+		writer.buffer.Truncate(n)
+		if e.protocol.Timestamped {
+			timestampWrite(e, writer)
+		}
+		if e.protocol.checksummed() {
+			checksumWrite(e, writer)
+		}
+		payload := writer.buffer.Bytes()
+		if err = e.transmit(context.Background(), payload, to, timeout); err != nil {
+			e.failed(payload, to, err)
+			return
+		}
+		var acked bool
+		if acked, err = e.awaitAck(address, seq, timeout); acked || err != nil {
+			return
+		}
+	}
+	return ErrNotAcknowledged
+}
+
+// awaitAck waits for an acknowledgment of the sequence number from the address
+// until the timeout. Timing out is not an error.
+func (e *Endpoint) awaitAck(address *net.UDPAddr, seq uint64, timeout time.Duration) (acked bool, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return false, nil
+		}
+		reader, from, err := e.ReceiveType(AckType, wait)
+		if err != nil {
+			if IsTimeout(err) {
+				err = nil
+			}
+			return false, err
+		}
+		body := reader.buffer.Bytes()
+		acked = len(body) == ackSize &&
+			binary.BigEndian.Uint64(body[1:]) == seq &&
+			from.Port == address.Port && from.IP.Equal(address.IP)
+		reader.Close()
+		if acked {
+			return true, nil
+		}
+	}
+}
+
+// ReceiveAndAck is the same as Receive but also sends an acknowledgment of the
+// sequence number back to the source before returning, for the SendReliable at
+// the other end. Acknowledgments received are returned without being
+// acknowledged themselves. If the acknowledgment cannot be sent the reader is
+// closed and the error returned, leaving the sender to try again. This requires
+// a Sequenced protocol, otherwise ErrUnsequenced is returned.
+func (e *Endpoint) ReceiveAndAck(timeout time.Duration) (reader *Reader, addr *net.UDPAddr, seq uint64, err error) {
+	if !e.protocol.Sequenced {
+		err = ErrUnsequenced
+		return
+	}
+	if reader, addr, seq, err = e.Receive(timeout); err != nil || reader == nil {
+		return
+	}
+	if body := reader.buffer.Bytes(); len(body) == ackSize && body[0] == AckType {
+		return
+	}
+	w := e.Writer()
+	w.WriteUint8(AckType)
+	w.WriteUint64(seq)
+	if err = e.Send(w, addr, timeout); err != nil {
+		reader.Close()
+		reader, addr, seq = nil, nil, 0
+	}
+	return
+}
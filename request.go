@@ -0,0 +1,94 @@
+package datagram
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"time"
+)
+
+// Request sends the UDP payload in the writer and then waits for a reply from
+// the same address, within the timeout. Payloads from other addresses are
+// discarded while waiting. The writer should not be used again after this call
+// and the returned reader must be closed after use.
+//
+// With a Sequenced protocol without a Codec the reply must be written with
+// ReplyWriter, and only a reply carrying the sequence number of the request is
+// returned, so that a late reply to an earlier request is discarded. The
+// returned reader starts after that sequence number. Otherwise replies are
+// matched by address alone.
+func (e *Endpoint) Request(writer *Writer, address *net.UDPAddr, timeout time.Duration) (reader *Reader, from *net.UDPAddr, err error) {
+	deadline := time.Now().Add(timeout)
+	var seq uint64
+	var sequenced bool
+	if writer.buffer != nil {
+		seq, sequenced = e.payloadSequence(writer.buffer.Bytes())
+	}
+	if err = e.Send(writer, address, timeout); err != nil {
+		return
+	}
+	for {
+		var wait time.Duration
+		if timeout > 0 {
+			if wait = time.Until(deadline); wait <= 0 {
+				err = e.opError(OpReceive, os.ErrDeadlineExceeded)
+				return
+			}
+		}
+		if reader, from, _, err = e.Receive(wait); err != nil {
+			return
+		}
+		if reader == nil {
+			continue
+		}
+		if from.Port == address.Port && from.IP.Equal(address.IP) {
+			if !sequenced {
+				return
+			}
+			if body := reader.buffer.Bytes(); len(body) >= 8 && binary.BigEndian.Uint64(body) == seq {
+				reader.buffer.Next(8)
+				return
+			}
+		}
+		reader.Close()
+	}
+}
+
+// ReplyWriter returns a writer for the reply to a request received with the
+// sequence number, which it writes first, so that Request can match the reply
+// to the request. The reply is sent with Send as usual. This is only needed
+// with a Sequenced protocol without a Codec.
+func (e *Endpoint) ReplyWriter(seq uint64) *Writer {
+	w := e.Writer()
+	w.WriteUint64(seq)
+	return w
+}
+
+// ReceiveWindow receives UDP payloads until the window has elapsed, calling the
+// function for each one until it returns false. Each reader is closed when the
+// function returns. This can be used to collect the replies to a query sent to
+// many addresses. The end of the window is not an error.
+func (e *Endpoint) ReceiveWindow(window time.Duration, fn func(*Reader, *net.UDPAddr) bool) error {
+	deadline := time.Now().Add(window)
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil
+		}
+		reader, addr, _, err := e.Receive(wait)
+		if err != nil {
+			if IsTimeout(err) {
+				return nil
+			}
+			return err
+		}
+		if reader == nil {
+			continue
+		}
+		more := fn(reader, addr)
+		reader.Close()
+		if !more {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package datagram
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// The reader and address returned by ReceiveReuse.
+type reuse struct {
+	reader Reader
+	addr   net.UDPAddr
+}
+
+// ReceiveReuse is the same as Receive but returns the same reader and address
+// every time, so that a receiver which deals with each payload before the next
+// does not allocate. Both are only valid until the next call and must not be
+// retained. The reader keeps its buffer from one call to the next, so closing it
+// is optional. This is not safe to call from more than one goroutine at a time.
+func (e *Endpoint) ReceiveReuse(timeout time.Duration) (reader *Reader, addr *net.UDPAddr, seq uint64, err error) {
+	into := &e.reuse.reader
+	buffer := into.buffer
+	into.buffer = nil
+	if reader, seq, err = e.receiveAddr(timeout, buffer, into, &e.reuse.addr); reader != nil {
+		addr = &e.reuse.addr
+	}
+	return
+}
+
+// ReceiveAddr is the same as Receive but sets the source address into the
+// given one rather than allocating a new address each time. The IP of the
+// address is also reused once it has the capacity for 16 bytes, so it must not
+// be retained between calls. The address is only meaningful if the reader is
+// not nil.
+func (e *Endpoint) ReceiveAddr(addr *net.UDPAddr, timeout time.Duration) (reader *Reader, seq uint64, err error) {
+	return e.receiveAddr(timeout, nil, nil, addr)
+}
+
+// receiveAddr receives into the buffer, or one from the pool if nil, and the
+// reader, or a new one if nil, setting the source address into dst.
+func (e *Endpoint) receiveAddr(timeout time.Duration, buffer *bytes.Buffer, into *Reader, dst *net.UDPAddr) (reader *Reader, seq uint64, err error) {
+	if e.sendOnly {
+		err = ErrSendOnly
+		return
+	}
+	if err = e.readDeadline(timeout); err != nil {
+		if buffer != nil {
+			e.buffers.Recycle(buffer)
+		}
+		return
+	}
+	if buffer == nil {
+		buffer = e.buffers.Next()
+	}
+	buffer.Reset()
+	buffer.Write(e.zero)
+	n, ap, err := e.conn.ReadFromUDPAddrPort(buffer.Bytes())
+	if err != nil {
+		e.buffers.Recycle(buffer)
+		err = e.readError(err)
+		return
+	}
+	setUDPAddr(dst, ap)
+	reader, seq, _, err = e.accept(buffer, n, dst, into)
+	return
+}
+
+// setUDPAddr sets the address from the netip.AddrPort, reusing its IP slice if
+// that is large enough.
+func setUDPAddr(dst *net.UDPAddr, ap netip.AddrPort) {
+	b := ap.Addr().As16()
+	dst.IP = append(dst.IP[:0], b[:]...)
+	dst.Port = int(ap.Port())
+	dst.Zone = ap.Addr().Zone()
+}
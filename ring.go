@@ -0,0 +1,52 @@
+package datagram
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A ReaderRing is a fixed set of readers, used in turn by ReceiveRing so that
+// no reader is allocated per datagram. Closing a reader returns it to the ring,
+// and readers may be closed on other goroutines.
+type ReaderRing struct {
+	readers []Reader
+	used    []atomic.Bool // Set while the reader of the same index is in use.
+	next    int           // The index of the next reader to use.
+}
+
+// Free returns the number of readers in the ring that are not in use.
+func (r *ReaderRing) Free() (n int) {
+	for i := range r.used {
+		if !r.used[i].Load() {
+			n++
+		}
+	}
+	return
+}
+
+// ReceiveRing is the same as Receive but uses the next reader from the ring
+// made by the WithReaderRing option. ErrRingFull is returned if that reader has
+// not yet been closed. Without the option this is the same as Receive. This is
+// not safe to call from more than one goroutine at a time.
+func (e *Endpoint) ReceiveRing(timeout time.Duration) (reader *Reader, addr *net.UDPAddr, seq uint64, err error) {
+	if e.ring == nil {
+		return e.Receive(timeout)
+	}
+	i := e.ring.next
+	if e.ring.used[i].Load() {
+		err = ErrRingFull
+		return
+	}
+	if reader, addr, seq, _, err = e.receive(timeout, &e.ring.readers[i]); reader != nil {
+		reader.slot = &e.ring.used[i]
+		e.ring.used[i].Store(true)
+		e.ring.next = (i + 1) % len(e.ring.readers)
+	}
+	return
+}
+
+// Ring returns the ring made by the WithReaderRing option, or nil.
+func (e *Endpoint) Ring() *ReaderRing {
+	return e.ring
+}
@@ -0,0 +1,90 @@
+package datagram
+
+import (
+	"reflect"
+	"strconv"
+)
+
+// schemaHeader is the space reserved for the hash and sequence headers by
+// ProtocolFromSchema.
+const schemaHeader = 16
+
+// ProtocolFromSchema returns a protocol whose Payload is large enough for the
+// body described by the given struct, plus the hash and sequence headers. The
+// Hash, HashString and Sequenced fields are left for the caller to set.
+//
+// Fields of type uint8, uint16, uint64, int64 and float64 take their size as
+// written by the Writer methods of the same name. Fields of type string or
+// []byte must have a tag giving their maximum length, for example
+//
+//	Name string `datagram:"32"`
+//
+// and are sized as written by Writer.Write, with a two byte length prefix.
+// Arrays and nested structs are summed from their elements. A field tagged with
+// `datagram:"-"` is ignored.
+func ProtocolFromSchema(v any) (*Protocol, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, ErrInvalidSchema
+	}
+	size, err := schemaSize(t, "")
+	if err != nil {
+		return nil, err
+	}
+	size += schemaHeader
+	if size > int(MaxPayload) {
+		return nil, ErrOverflow
+	}
+	return &Protocol{Payload: uint16(size)}, nil
+}
+
+// schemaSize returns the encoded size of the type, using the tag for the
+// maximum length of strings and byte slices.
+func schemaSize(t reflect.Type, tag string) (int, error) {
+	switch t.Kind() {
+	case reflect.Uint8:
+		return 1, nil
+	case reflect.Uint16:
+		return 2, nil
+	case reflect.Uint64, reflect.Int64, reflect.Float64:
+		return 8, nil
+	case reflect.String:
+		return schemaLength(tag)
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.Uint8 {
+			return 0, ErrInvalidSchema
+		}
+		return schemaLength(tag)
+	case reflect.Array:
+		n, err := schemaSize(t.Elem(), tag)
+		return n * t.Len(), err
+	case reflect.Struct:
+		total := 0
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("datagram")
+			if tag == "-" {
+				continue
+			}
+			n, err := schemaSize(f.Type, tag)
+			if err != nil {
+				return 0, err
+			}
+			total += n
+		}
+		return total, nil
+	}
+	return 0, ErrInvalidSchema
+}
+
+// schemaLength returns the size of a length prefixed field, from its tag.
+func schemaLength(tag string) (int, error) {
+	n, err := strconv.Atoi(tag)
+	if err != nil || n < 0 {
+		return 0, ErrInvalidSchema
+	}
+	return 2 + n, nil
+}
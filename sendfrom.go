@@ -0,0 +1,19 @@
+package datagram
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// SendFrom is the same as Send but the datagram is sent from the given local
+// address, which is useful when the end point is bound to all addresses of a
+// multi-homed host. Only the IP of the source address is used. This is only
+// supported on Linux, elsewhere ErrNotSupported is returned.
+func (e *Endpoint) SendFrom(writer *Writer, src, dst *net.UDPAddr, timeout time.Duration) error {
+	oob, err := sourceOOB(src)
+	if err != nil {
+		return err
+	}
+	return e.sendWriter(context.Background(), writer, target{udp: dst, oob: oob}, timeout)
+}
@@ -0,0 +1,36 @@
+package datagram
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// sourceOOB returns the control message to send from the source address.
+func sourceOOB(src *net.UDPAddr) ([]byte, error) {
+	if src == nil {
+		return nil, ErrInvalidAddress
+	}
+	if ip4 := src.IP.To4(); ip4 != nil {
+		var info syscall.Inet4Pktinfo
+		copy(info.Spec_dst[:], ip4)
+		return controlMessage(syscall.IPPROTO_IP, syscall.IP_PKTINFO, unsafe.Slice((*byte)(unsafe.Pointer(&info)), syscall.SizeofInet4Pktinfo)), nil
+	}
+	if ip16 := src.IP.To16(); ip16 != nil {
+		var info syscall.Inet6Pktinfo
+		copy(info.Addr[:], ip16)
+		return controlMessage(syscall.IPPROTO_IPV6, syscall.IPV6_PKTINFO, unsafe.Slice((*byte)(unsafe.Pointer(&info)), syscall.SizeofInet6Pktinfo)), nil
+	}
+	return nil, ErrInvalidAddress
+}
+
+// controlMessage returns a socket control message with the data.
+func controlMessage(level, typ int, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
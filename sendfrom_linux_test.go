@@ -0,0 +1,36 @@
+package datagram
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendFrom(t *testing.T) {
+	receiver, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	sender, err := NewEndpoint(&testprotocol, 0, 8)
+	assert.Nil(t, err)
+	defer sender.Close()
+	//
+	// All of 127.0.0.0/8 is local on Linux, so the datagram can be sent from an
+	// address other than the usual loopback one.
+	//
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: receiver.LocalPort()}
+	for _, src := range []net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 3)} {
+		w := sender.Writer()
+		w.WriteUint64(1)
+		assert.Nil(t, sender.SendFrom(w, &net.UDPAddr{IP: src}, to, 20*time.Millisecond))
+		reader, addr, _, err := receiver.Receive(20 * time.Millisecond)
+		assert.Nil(t, err)
+		if assert.NotNil(t, reader) {
+			reader.Close()
+		}
+		assert.True(t, src.Equal(addr.IP), addr.String())
+		assert.Equal(t, sender.LocalPort(), addr.Port)
+	}
+	assert.Equal(t, ErrInvalidAddress, sender.SendFrom(sender.Writer(), nil, to, 20*time.Millisecond))
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package datagram
+
+import (
+	"net"
+)
+
+func sourceOOB(src *net.UDPAddr) ([]byte, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,45 @@
+package datagram
+
+import (
+	"github.com/gbkr-com/app"
+)
+
+// A SharedPool holds payload buffers and writers for any number of end points
+// made by NewEndpointShared, so that memory grows with the number of payloads
+// in use rather than with the number of end points.
+type SharedPool struct {
+	payload int // The largest payload of the end points.
+	size    int
+	buffers *bufferPool
+	writers *app.Pool[*Writer]
+}
+
+// NewSharedPool returns a pool keeping the given number of buffers and writers
+// for recycling, for end points with payloads of up to the given size. This
+// will panic if the payload is zero or the size is less than one.
+func NewSharedPool(payload uint16, size int) *SharedPool {
+	if payload == 0 {
+		panic("payload")
+	}
+	if size < 1 {
+		panic("pool")
+	}
+	return &SharedPool{
+		payload: int(payload),
+		size:    size,
+		buffers: newBufferPool(size, int(payload), int(payload), 0),
+		writers: newWriterPool(size),
+	}
+}
+
+// NewEndpointShared is the same as NewEndpoint but the end point takes its
+// buffers and writers from the shared pool rather than having its own. The
+// payload of the end point cannot be larger than that of the pool, and the
+// WithArena option has no effect. OutstandingBuffers then counts the buffers of
+// every end point sharing the pool.
+func NewEndpointShared(protocol *Protocol, port int, pool *SharedPool, options ...func(*Endpoint)) (*Endpoint, error) {
+	if pool == nil {
+		panic("pool")
+	}
+	return newEndpoint(protocol, port, pool.size, pool, options...)
+}
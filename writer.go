@@ -3,74 +3,424 @@ package datagram
 import (
 	"bytes"
 	"encoding/binary"
+	"math"
+	"time"
+	"unicode/utf8"
 )
 
 // A Writer provides methods to write a UDP payload.
 type Writer struct {
 	buffer *bytes.Buffer
+	limit  int   // The maximum payload size.
+	header int   // The length of the protocol header.
+	frame  int   // The width of the length field written by Write.
+	err    error // Set if the writer can never be used.
+}
+
+// Len returns the number of bytes written into the payload, including the
+// protocol header.
+func (w *Writer) Len() int {
+	if w.buffer == nil {
+		return 0
+	}
+	return w.buffer.Len()
+}
+
+// Truncate discards everything written after the first length bytes of the
+// payload, for example to roll back to a length saved from Len. The length
+// cannot be more than Len or less than the protocol header.
+func (w *Writer) Truncate(length int) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.buffer == nil {
+		return ErrClosedWriter
+	}
+	if length < w.header || length > w.buffer.Len() {
+		return ErrInvalidLength
+	}
+	w.buffer.Truncate(length)
+	return nil
+}
+
+// Save returns a mark for the current state of the writer, to be given to
+// Restore if what is written next is to be abandoned.
+func (w *Writer) Save() int {
+	return w.Len()
+}
+
+// Restore the writer to the state when Save returned the mark, discarding
+// everything written since.
+func (w *Writer) Restore(mark int) error {
+	return w.Truncate(mark)
 }
 
 // Remaining returns the number of bytes that can be written into the payload.
 func (w *Writer) Remaining() int {
-	return w.buffer.Cap() - w.buffer.Len()
+	if w.buffer == nil {
+		return 0
+	}
+	return w.limit - w.buffer.Len()
 }
 
-// WriteUint16 writes the argument as two bytes into the payload.
-func (w *Writer) WriteUint16(v uint16) error {
+// Bytes returns a copy of the payload written so far, including the protocol
+// header. Any padding and checksum are only added by Send.
+func (w *Writer) Bytes() []byte {
+	if w.buffer == nil {
+		return nil
+	}
+	b := make([]byte, w.buffer.Len())
+	copy(b, w.buffer.Bytes())
+	return b
+}
+
+// Template returns a copy of the body written so far, without the protocol
+// header, for use with Endpoint.SendTemplate.
+func (w *Writer) Template() []byte {
+	if w.buffer == nil {
+		return nil
+	}
+	body := w.buffer.Bytes()[w.header:]
+	tmpl := make([]byte, len(body))
+	copy(tmpl, body)
+	return tmpl
+}
+
+// check returns an error if the writer is closed or n more bytes would
+// overflow the payload.
+func (w *Writer) check(n int) error {
+	if w.err != nil {
+		return w.err
+	}
 	if w.buffer == nil {
 		return ErrClosedWriter
 	}
-	if w.buffer.Cap() < w.buffer.Len()+2 {
+	if w.buffer.Len()+n > w.limit {
 		return ErrOverflow
 	}
+	return nil
+}
+
+// AlignTo writes zero bytes until the length of the body, excluding the
+// protocol header, is a multiple of the boundary, so that the next field is
+// aligned. Reader.AlignTo skips the same padding.
+func (w *Writer) AlignTo(boundary int) error {
+	if boundary < 1 {
+		return ErrInvalidLength
+	}
+	pad := alignment(w.Len()-w.header, boundary)
+	if err := w.check(pad); err != nil {
+		return err
+	}
+	for i := 0; i < pad; i++ {
+		w.buffer.WriteByte(0)
+	}
+	return nil
+}
+
+// alignment returns the padding needed after offset to reach a multiple of the
+// boundary.
+func alignment(offset, boundary int) int {
+	return (boundary - offset%boundary) % boundary
+}
+
+// WriteUint16 writes the argument as two bytes into the payload.
+func (w *Writer) WriteUint16(v uint16) error {
+	if err := w.check(2); err != nil {
+		return err
+	}
 	return binary.Write(w.buffer, binary.BigEndian, v)
 }
 
 // WriteUint64 writes the argument as 8 bytes into the payload.
 func (w *Writer) WriteUint64(v uint64) error {
-	if w.buffer == nil {
-		return ErrClosedWriter
-	}
-	if w.buffer.Cap() < w.buffer.Len()+8 {
-		return ErrOverflow
+	if err := w.check(8); err != nil {
+		return err
 	}
 	return binary.Write(w.buffer, binary.BigEndian, v)
 }
 
 // WriteInt64 writes the argument as 8 bytes into the payload.
 func (w *Writer) WriteInt64(v int64) error {
-	if w.buffer == nil {
-		return ErrClosedWriter
-	}
-	if w.buffer.Cap() < w.buffer.Len()+8 {
-		return ErrOverflow
+	if err := w.check(8); err != nil {
+		return err
 	}
 	return binary.Write(w.buffer, binary.BigEndian, v)
 }
 
 // WriteFloat64 writes the argument as 8 bytes into the payload.
 func (w *Writer) WriteFloat64(v float64) error {
-	if w.buffer == nil {
-		return ErrClosedWriter
-	}
-	if w.buffer.Cap() < w.buffer.Len()+8 {
-		return ErrOverflow
+	if err := w.check(8); err != nil {
+		return err
 	}
 	return binary.Write(w.buffer, binary.BigEndian, v)
 }
 
-// Write the byte slice to the payload, preceded by a two byte length field.
+// Write the byte slice to the payload, preceded by a length field. This is two
+// bytes unless the protocol has a different FrameLengthBytes.
 func (w *Writer) Write(v []byte) (err error) {
-	if w.buffer == nil {
-		return ErrClosedWriter
+	if w.err != nil {
+		return w.err
 	}
-	if w.buffer.Cap() < len(v)+2 {
+	if len(v) > int(MaxOversizePayload) || len(v) > maxFrameLength(w.frame) {
 		return ErrOverflow
 	}
-	length := uint16(len(v))
-	if err = binary.Write(w.buffer, binary.BigEndian, &length); err != nil {
+	if err = w.check(len(v) + w.frame); err != nil {
 		return
 	}
+	var b [4]byte
+	putFrameLength(b[:w.frame], len(v))
+	w.buffer.Write(b[:w.frame])
 	w.buffer.Write(v)
 	return
 }
+
+// WriteVarBytes writes the byte slice to the payload, preceded by its length
+// as a uvarint. This takes a single byte for slices shorter than 128 bytes.
+func (w *Writer) WriteVarBytes(v []byte) error {
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(v)))
+	if err := w.check(n + len(v)); err != nil {
+		return err
+	}
+	w.buffer.Write(prefix[:n])
+	w.buffer.Write(v)
+	return nil
+}
+
+// WriteRuneString writes the string to the payload preceded by two uint16
+// fields, the number of runes and then the number of bytes, so that the
+// receiver can size a []rune before decoding.
+func (w *Writer) WriteRuneString(s string) error {
+	if len(s) > math.MaxUint16 {
+		return ErrOverflow
+	}
+	if err := w.check(4 + len(s)); err != nil {
+		return err
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint16(b[:], uint16(utf8.RuneCountInString(s)))
+	binary.BigEndian.PutUint16(b[2:], uint16(len(s)))
+	w.buffer.Write(b[:])
+	w.buffer.WriteString(s)
+	return nil
+}
+
+// WriteUvarintSlice writes the values to the payload as a uvarint count followed
+// by each value as a uvarint. Nothing is written if the values do not fit.
+func (w *Writer) WriteUvarintSlice(vs []uint64) error {
+	var scratch [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(scratch[:], uint64(len(vs)))
+	for _, v := range vs {
+		size += binary.PutUvarint(scratch[:], v)
+	}
+	if err := w.check(size); err != nil {
+		return err
+	}
+	n := binary.PutUvarint(scratch[:], uint64(len(vs)))
+	w.buffer.Write(scratch[:n])
+	for _, v := range vs {
+		n = binary.PutUvarint(scratch[:], v)
+		w.buffer.Write(scratch[:n])
+	}
+	return nil
+}
+
+// WriteInt64Slice writes the values to the payload as a uvarint count followed
+// by eight bytes for each value. Nothing is written if the values do not fit.
+func (w *Writer) WriteInt64Slice(vs []int64) error {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(len(vs)))
+	if err := w.check(n + 8*len(vs)); err != nil {
+		return err
+	}
+	w.buffer.Write(b[:n])
+	for _, v := range vs {
+		binary.BigEndian.PutUint64(b[:], uint64(v))
+		w.buffer.Write(b[:8])
+	}
+	return nil
+}
+
+// WriteVarString writes the string to the payload, preceded by its length in
+// bytes as a uvarint.
+func (w *Writer) WriteVarString(s string) error {
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(s)))
+	if err := w.check(n + len(s)); err != nil {
+		return err
+	}
+	w.buffer.Write(prefix[:n])
+	w.buffer.WriteString(s)
+	return nil
+}
+
+// WriteDecimal writes an exact fixed-point value, the mantissa times ten to the
+// power of minus the scale, as eight bytes of mantissa and one of scale. For
+// example 123.45 is the mantissa 12345 with the scale 2.
+func (w *Writer) WriteDecimal(mantissa int64, scale int8) error {
+	if err := w.check(9); err != nil {
+		return err
+	}
+	var b [9]byte
+	binary.BigEndian.PutUint64(b[:], uint64(mantissa))
+	b[8] = byte(scale)
+	w.buffer.Write(b[:])
+	return nil
+}
+
+// WriteStringSlice writes the strings to the payload as a uint16 count followed
+// by each string preceded by a length field, as for Write. Nothing is written if
+// the strings do not fit.
+func (w *Writer) WriteStringSlice(ss []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(ss) > math.MaxUint16 {
+		return ErrOverflow
+	}
+	size := 2
+	for _, s := range ss {
+		if len(s) > maxFrameLength(w.frame) {
+			return ErrOverflow
+		}
+		size += w.frame + len(s)
+	}
+	if err := w.check(size); err != nil {
+		return err
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint16(b[:], uint16(len(ss)))
+	w.buffer.Write(b[:2])
+	for _, s := range ss {
+		putFrameLength(b[:w.frame], len(s))
+		w.buffer.Write(b[:w.frame])
+		w.buffer.WriteString(s)
+	}
+	return nil
+}
+
+// WriteFloat64Delta writes the difference between the value and the previous
+// value, as 8 bytes, into the payload. Note that floating point subtraction
+// can lose precision, so ReadFloat64Delta may not restore the exact value.
+func (w *Writer) WriteFloat64Delta(v, prev float64) error {
+	return w.WriteFloat64(v - prev)
+}
+
+// WriteZigzag writes the argument into the payload as a zigzag encoded varint,
+// so that values of small magnitude take few bytes whatever their sign: -1, 0
+// and 1 each take a single byte.
+func (w *Writer) WriteZigzag(v int64) error {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v) // PutVarint uses zigzag encoding.
+	if err := w.check(n); err != nil {
+		return err
+	}
+	w.buffer.Write(b[:n])
+	return nil
+}
+
+// WriteUint8 writes the argument as one byte into the payload.
+func (w *Writer) WriteUint8(v uint8) error {
+	if err := w.check(1); err != nil {
+		return err
+	}
+	return w.buffer.WriteByte(v)
+}
+
+// WriteUnixSeconds writes the time as four bytes of Unix seconds, discarding
+// any fraction of a second. Times before 1970 or from February 2106, when the
+// seconds no longer fit in 32 bits, do not survive the round trip.
+func (w *Writer) WriteUnixSeconds(t time.Time) error {
+	if err := w.check(4); err != nil {
+		return err
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(t.Unix()))
+	w.buffer.Write(b[:])
+	return nil
+}
+
+// WriteUUID writes the UUID as its 16 bytes into the payload.
+func (w *Writer) WriteUUID(u [16]byte) error {
+	if err := w.check(len(u)); err != nil {
+		return err
+	}
+	w.buffer.Write(u[:])
+	return nil
+}
+
+// WriteSendTime writes the current time to the payload as eight bytes of Unix
+// nanoseconds, for the receiver to measure the delay with OneWayDelay.
+func (w *Writer) WriteSendTime() error {
+	return w.WriteInt64(time.Now().UnixNano())
+}
+
+// WriteRepeated writes a run of count copies of the byte as the byte followed
+// by the count as a uvarint.
+func (w *Writer) WriteRepeated(b byte, count int) error {
+	if count < 0 {
+		return ErrInvalidLength
+	}
+	var buf [1 + binary.MaxVarintLen64]byte
+	buf[0] = b
+	n := 1 + binary.PutUvarint(buf[1:], uint64(count))
+	if err := w.check(n); err != nil {
+		return err
+	}
+	w.buffer.Write(buf[:n])
+	return nil
+}
+
+// WriteBitSet writes the lowest n bits of the argument, n being at most 64, into
+// the payload in as few bytes as possible.
+func (w *Writer) WriteBitSet(bits uint64, n int) error {
+	if n < 0 || n > 64 {
+		return ErrInvalidLength
+	}
+	size := (n + 7) / 8
+	if err := w.check(size); err != nil {
+		return err
+	}
+	if n < 64 {
+		bits &= 1<<n - 1
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], bits)
+	w.buffer.Write(b[8-size:])
+	return nil
+}
+
+// WriteTLV writes a tag-length-value record into the payload: a two byte tag,
+// a two byte length and then the value.
+func (w *Writer) WriteTLV(tag uint16, value []byte) error {
+	if len(value) > math.MaxUint16 {
+		return ErrOverflow
+	}
+	if err := w.check(4 + len(value)); err != nil {
+		return err
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint16(b[:], tag)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(value)))
+	w.buffer.Write(b[:])
+	w.buffer.Write(value)
+	return nil
+}
+
+// WriteWriter appends the body written into another writer, excluding its
+// protocol header, to this payload. The other writer is not changed.
+func (w *Writer) WriteWriter(src *Writer) error {
+	if src.err != nil {
+		return src.err
+	}
+	if src.buffer == nil {
+		return ErrClosedWriter
+	}
+	body := src.buffer.Bytes()[src.header:]
+	if err := w.check(len(body)); err != nil {
+		return err
+	}
+	w.buffer.Write(body)
+	return nil
+}